@@ -0,0 +1,85 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/cloudbase/garm-provider-aws/internal/spec"
+	"github.com/cloudbase/garm-provider-aws/provider"
+)
+
+const (
+	cleanupNetworkCommand   = "cleanup-network"
+	extraSpecsSchemaCommand = "extra-specs-schema"
+)
+
+// runCommand runs an operator command given on the command line. These are
+// not used by garm, which drives the provider through environment variables.
+func runCommand(ctx context.Context, args []string) error {
+	switch args[0] {
+	case cleanupNetworkCommand:
+		return runCleanupNetwork(ctx, args[1:])
+	case extraSpecsSchemaCommand:
+		return runExtraSpecsSchema()
+	default:
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+}
+
+func runCleanupNetwork(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet(cleanupNetworkCommand, flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv("GARM_PROVIDER_CONFIG_FILE"), "path to the provider config file")
+	controllerID := flags.String("controller-id", os.Getenv("GARM_CONTROLLER_ID"), "garm controller ID")
+	dryRun := flags.Bool("dry-run", false, "only list the resources that would be removed")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *configFile == "" {
+		return fmt.Errorf("missing -config")
+	}
+	if *controllerID == "" {
+		return fmt.Errorf("missing -controller-id")
+	}
+
+	prov, err := provider.NewAwsProvider(ctx, *configFile, *controllerID)
+	if err != nil {
+		return fmt.Errorf("failed to create provider: %w", err)
+	}
+
+	resources, err := prov.CleanupNetwork(ctx, *dryRun)
+	for _, resource := range resources {
+		if *dryRun {
+			fmt.Fprintf(os.Stdout, "would remove %s\n", resource)
+		} else {
+			fmt.Fprintf(os.Stdout, "removed %s\n", resource)
+		}
+	}
+	return err
+}
+
+func runExtraSpecsSchema() error {
+	asJs, err := json.MarshalIndent(spec.ExtraSpecsSchema(), "", "    ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal schema: %w", err)
+	}
+	fmt.Fprintln(os.Stdout, string(asJs))
+	return nil
+}
@@ -17,10 +17,26 @@ package config
 import (
 	"context"
 	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+const (
+	defaultRoleSessionName = "garm-provider-aws"
+	defaultVpcCIDR         = "10.10.0.0/16"
+	defaultSubnetCIDR      = "10.10.0.0/24"
+	// defaultCapacityCooldown is how long a capacity failure is remembered
+	// when no cool-down is configured.
+	defaultCapacityCooldown = 10 * time.Minute
 )
 
 // NewConfig returns a new Config
@@ -36,63 +52,343 @@ func NewConfig(cfgFile string) (*Config, error) {
 	return &config, nil
 }
 
+type NetworkMode string
+
+const (
+	// NetworkModeExisting launches runners into existing subnets.
+	NetworkModeExisting NetworkMode = "existing"
+	// NetworkModeManaged lets the provider create the network runners
+	// are launched into.
+	NetworkModeManaged NetworkMode = "managed"
+)
+
+type AZOrder string
+
+const (
+	// AZOrderRandom tries the subnets of a pool in random order.
+	AZOrderRandom AZOrder = "random"
+	// AZOrderRoundRobin rotates the first subnet tried between launches.
+	AZOrderRoundRobin AZOrder = "round-robin"
+	// AZOrderPreferredFirst tries the subnets in the order they are listed.
+	AZOrderPreferredFirst AZOrder = "preferred-first"
+)
+
+// Validate checks the AZ order is known.
+func (o AZOrder) Validate() error {
+	switch o {
+	case AZOrderRandom, AZOrderRoundRobin, AZOrderPreferredFirst:
+		return nil
+	default:
+		return fmt.Errorf("invalid az_order: %s", o)
+	}
+}
+
 type Config struct {
 	Credentials Credentials `toml:"credentials"`
 	Region      string      `toml:"region"`
+
+	// NetworkMode selects how runners get their network. Defaults to
+	// "existing", which requires subnet IDs either here or in the pool
+	// extra specs.
+	NetworkMode NetworkMode `toml:"network_mode"`
+	// SubnetIDs is a list of existing subnets runners may be launched into.
+	SubnetIDs []string `toml:"subnet_ids"`
+	// AZOrder is the order in which the subnets, and with them the
+	// availability zones, of a pool are tried when launching runners.
+	// Defaults to "random".
+	AZOrder AZOrder `toml:"az_order"`
+	// SecurityGroupIDs is a list of existing security groups attached to runners.
+	SecurityGroupIDs []string `toml:"security_group_ids"`
+	// SecurityGroupNames is a list of existing security groups attached to
+	// runners, by name. Names are looked up in the VPC of the runner subnet.
+	SecurityGroupNames []string `toml:"security_group_names"`
+	// ManagedSecurityGroup configures the security group the provider
+	// creates for runners that have no other security group.
+	ManagedSecurityGroup ManagedSecurityGroup `toml:"managed_security_group"`
+	// Hibernate launches runners with hibernation enabled and hibernates
+	// them instead of stopping them. Pools can override this in extra specs.
+	Hibernate bool `toml:"hibernate"`
+	// ManagedNetwork configures the network created in managed network mode.
+	ManagedNetwork ManagedNetwork `toml:"managed_network"`
+	// RootVolume configures the root EBS volume of runners. Pools can
+	// override individual fields in extra specs.
+	RootVolume EBSVolume `toml:"root_volume"`
+	// DataVolumes are additional EBS volumes attached to runners.
+	DataVolumes []EBSVolume `toml:"data_volumes"`
+	// Timeouts configures how long operations wait for instances to reach
+	// the desired state.
+	Timeouts Timeouts `toml:"timeouts"`
+	// CacheDir holds state kept between provider invocations, like resolved
+	// instance types. Defaults to garm-provider-aws in the user cache dir.
+	CacheDir string `toml:"cache_dir"`
+	// CapacityCooldown is how long an availability zone that ran out of
+	// capacity for an instance type is skipped by later launches of that
+	// type. Defaults to 10 minutes.
+	CapacityCooldown time.Duration `toml:"capacity_cooldown"`
+}
+
+// Timeouts holds how long each operation waits for the instance to reach its
+// target state. A zero value returns as soon as EC2 accepted the request.
+type Timeouts struct {
+	// CreateInstance waits for new instances to be running.
+	CreateInstance time.Duration `toml:"create_instance"`
+	// StartInstance waits for started instances to be running.
+	StartInstance time.Duration `toml:"start_instance"`
+	// StopInstance waits for instances to be stopped.
+	StopInstance time.Duration `toml:"stop_instance"`
+	// DeleteInstance waits for instances to be terminated.
+	DeleteInstance time.Duration `toml:"delete_instance"`
+}
+
+func (t Timeouts) Validate() error {
+	if t.CreateInstance < 0 {
+		return fmt.Errorf("invalid create_instance timeout")
+	}
+	if t.StartInstance < 0 {
+		return fmt.Errorf("invalid start_instance timeout")
+	}
+	if t.StopInstance < 0 {
+		return fmt.Errorf("invalid stop_instance timeout")
+	}
+	if t.DeleteInstance < 0 {
+		return fmt.Errorf("invalid delete_instance timeout")
+	}
+	return nil
+}
+
+type ManagedNetwork struct {
+	// VpcCIDR is the CIDR of the controller VPC. Defaults to 10.10.0.0/16.
+	VpcCIDR string `toml:"vpc_cidr"`
+	// SubnetCIDR is the CIDR of the controller subnet. Defaults to 10.10.0.0/24.
+	SubnetCIDR string `toml:"subnet_cidr"`
+}
+
+func (m *ManagedNetwork) Validate() error {
+	if m.VpcCIDR == "" {
+		m.VpcCIDR = defaultVpcCIDR
+	}
+	if m.SubnetCIDR == "" {
+		m.SubnetCIDR = defaultSubnetCIDR
+	}
+
+	_, vpcNet, err := net.ParseCIDR(m.VpcCIDR)
+	if err != nil {
+		return fmt.Errorf("invalid vpc_cidr: %w", err)
+	}
+	subnetIP, _, err := net.ParseCIDR(m.SubnetCIDR)
+	if err != nil {
+		return fmt.Errorf("invalid subnet_cidr: %w", err)
+	}
+	if !vpcNet.Contains(subnetIP) {
+		return fmt.Errorf("subnet_cidr %s is not inside vpc_cidr %s", m.SubnetCIDR, m.VpcCIDR)
+	}
+	return nil
+}
+
+// ManagedSecurityGroup configures the controller owned security group of
+// runners. The group allows all egress and only the ingress listed here.
+type ManagedSecurityGroup struct {
+	// Enabled attaches the managed security group to runners that have no
+	// security group set, instead of leaving them in the default group of
+	// the VPC.
+	Enabled bool `toml:"enabled"`
+	// SSHCIDRs are the networks allowed to connect to runners over SSH.
+	SSHCIDRs []string `toml:"ssh_cidrs"`
+	// WinRMCIDRs are the networks allowed to connect to runners over WinRM.
+	WinRMCIDRs []string `toml:"winrm_cidrs"`
+}
+
+func (m ManagedSecurityGroup) Validate() error {
+	if !m.Enabled && (len(m.SSHCIDRs) > 0 || len(m.WinRMCIDRs) > 0) {
+		return fmt.Errorf("ingress CIDRs require enabled")
+	}
+	for _, cidr := range m.SSHCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid ssh_cidrs: %w", err)
+		}
+	}
+	for _, cidr := range m.WinRMCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid winrm_cidrs: %w", err)
+		}
+	}
+	return nil
 }
 
 func (c *Config) Validate() error {
 	if c.Region == "" {
 		return fmt.Errorf("missing region")
 	}
+	switch c.NetworkMode {
+	case "":
+		c.NetworkMode = NetworkModeExisting
+	case NetworkModeExisting, NetworkModeManaged:
+	default:
+		return fmt.Errorf("invalid network_mode: %s", c.NetworkMode)
+	}
+	if c.AZOrder == "" {
+		c.AZOrder = AZOrderRandom
+	}
+	if err := c.AZOrder.Validate(); err != nil {
+		return err
+	}
+	if err := c.ManagedNetwork.Validate(); err != nil {
+		return fmt.Errorf("failed to validate managed_network: %w", err)
+	}
+	if err := c.ManagedSecurityGroup.Validate(); err != nil {
+		return fmt.Errorf("failed to validate managed_security_group: %w", err)
+	}
+	if err := c.Timeouts.Validate(); err != nil {
+		return fmt.Errorf("failed to validate timeouts: %w", err)
+	}
+	if err := c.RootVolume.ValidateRoot(); err != nil {
+		return fmt.Errorf("invalid root_volume.%w", err)
+	}
+	if err := ValidateDataVolumes(c.DataVolumes); err != nil {
+		return fmt.Errorf("invalid %w", err)
+	}
 	if err := c.Credentials.Validate(); err != nil {
 		return fmt.Errorf("failed to validate credentials: %w", err)
 	}
+	if c.CacheDir == "" {
+		c.CacheDir = defaultCacheDir()
+	}
+	switch {
+	case c.CapacityCooldown == 0:
+		c.CapacityCooldown = defaultCapacityCooldown
+	case c.CapacityCooldown < 0:
+		return fmt.Errorf("invalid capacity_cooldown")
+	}
 
 	return nil
 }
 
+// defaultCacheDir returns the cache dir used when none is configured. The
+// user cache dir is not set for service accounts without a home dir.
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "garm-provider-aws")
+}
+
 type Credentials struct {
-	// AWS Access key ID
+	// AWS Access key ID. When set, static credentials are used instead of
+	// the default credential chain.
 	AccessKeyID string `toml:"access_key_id"`
 
 	// AWS Secret Access Key
 	SecretAccessKey string `toml:"secret_access_key"`
 
-	// AWS Session Token
+	// AWS Session Token. Only needed for temporary static credentials.
 	SessionToken string `toml:"session_token"`
+
+	// Profile is the name of a profile in the shared config and credentials
+	// files. Mutually exclusive with static credentials.
+	Profile string `toml:"profile"`
+
+	// AssumeRole optionally assumes an IAM role using the credentials
+	// resolved above.
+	AssumeRole AssumeRole `toml:"assume_role"`
 }
 
 func (c Credentials) Validate() error {
-	if c.AccessKeyID == "" {
-		return fmt.Errorf("missing access_key_id")
-	}
-	if c.SecretAccessKey == "" {
-		return fmt.Errorf("missing secret_access_key")
+	if c.AccessKeyID != "" || c.SecretAccessKey != "" || c.SessionToken != "" {
+		if c.AccessKeyID == "" {
+			return fmt.Errorf("missing access_key_id")
+		}
+		if c.SecretAccessKey == "" {
+			return fmt.Errorf("missing secret_access_key")
+		}
+		if c.Profile != "" {
+			return fmt.Errorf("profile and static credentials are mutually exclusive")
+		}
 	}
 
-	if c.SessionToken == "" {
-		return fmt.Errorf("missing session_token")
+	if err := c.AssumeRole.Validate(); err != nil {
+		return fmt.Errorf("failed to validate assume_role: %w", err)
 	}
 
 	return nil
 }
 
-func (c Credentials) GetCredentials() (aws.Credentials, error) {
-	creds := aws.Credentials{
-		AccessKeyID:     c.AccessKeyID,
-		SecretAccessKey: c.SecretAccessKey,
-		SessionToken:    c.SessionToken,
+func (c Credentials) hasStaticCredentials() bool {
+	return c.AccessKeyID != "" && c.SecretAccessKey != ""
+}
+
+type AssumeRole struct {
+	// RoleARN is the ARN of the role to assume. Leave empty to disable.
+	RoleARN string `toml:"role_arn"`
+
+	// ExternalID is the external ID required by the role trust policy, if any.
+	ExternalID string `toml:"external_id"`
+
+	// SessionName is the role session name. Defaults to garm-provider-aws.
+	SessionName string `toml:"session_name"`
+
+	// Duration is the lifetime of the assumed role credentials (eg: "1h").
+	Duration time.Duration `toml:"duration"`
+}
+
+func (a AssumeRole) Validate() error {
+	if a.RoleARN == "" {
+		if a.ExternalID != "" || a.SessionName != "" || a.Duration != 0 {
+			return fmt.Errorf("missing role_arn")
+		}
+		return nil
+	}
+
+	if a.Duration != 0 && (a.Duration < 15*time.Minute || a.Duration > 12*time.Hour) {
+		return fmt.Errorf("duration must be between 15m and 12h")
 	}
 
-	return creds, nil
+	return nil
 }
 
-func Retrieve(ctx context.Context) (aws.Credentials, error) {
-	cfg, err := config.LoadDefaultConfig(ctx)
+// GetAWSConfig loads the AWS config for the configured region, resolving
+// credentials from static keys, a shared config profile or the default
+// credential chain, and optionally assuming a role on top of them.
+func (c *Config) GetAWSConfig(ctx context.Context) (aws.Config, error) {
+	opts := []func(*config.LoadOptions) error{
+		config.WithRegion(c.Region),
+	}
+
+	if c.Credentials.Profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(c.Credentials.Profile))
+	}
+
+	if c.Credentials.hasStaticCredentials() {
+		opts = append(opts, config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(
+				c.Credentials.AccessKeyID,
+				c.Credentials.SecretAccessKey,
+				c.Credentials.SessionToken,
+			),
+		))
+	}
+
+	awsCfg, err := config.LoadDefaultConfig(ctx, opts...)
 	if err != nil {
-		return aws.Credentials{}, fmt.Errorf("failed to load config: %w", err)
+		return aws.Config{}, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	if assumeRole := c.Credentials.AssumeRole; assumeRole.RoleARN != "" {
+		stsClient := sts.NewFromConfig(awsCfg)
+		provider := stscreds.NewAssumeRoleProvider(stsClient, assumeRole.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = defaultRoleSessionName
+			if assumeRole.SessionName != "" {
+				o.RoleSessionName = assumeRole.SessionName
+			}
+			if assumeRole.ExternalID != "" {
+				o.ExternalID = aws.String(assumeRole.ExternalID)
+			}
+			if assumeRole.Duration != 0 {
+				o.Duration = assumeRole.Duration
+			}
+		})
+		awsCfg.Credentials = aws.NewCredentialsCache(provider)
 	}
 
-	return cfg.Credentials.Retrieve(ctx)
+	return awsCfg, nil
 }
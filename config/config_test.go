@@ -0,0 +1,92 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCredentialsValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		credentials Credentials
+		// errMsg is a substring the error must contain. Empty means success.
+		errMsg string
+	}{
+		{name: "default chain", credentials: Credentials{}},
+		{name: "static", credentials: Credentials{AccessKeyID: "AKIA", SecretAccessKey: "secret"}},
+		{name: "static with session token", credentials: Credentials{AccessKeyID: "AKIA", SecretAccessKey: "secret", SessionToken: "token"}},
+		{name: "profile", credentials: Credentials{Profile: "garm"}},
+		{name: "profile with role", credentials: Credentials{Profile: "garm", AssumeRole: AssumeRole{RoleARN: "arn:aws:iam::123456789012:role/garm"}}},
+		{name: "missing access key", credentials: Credentials{SecretAccessKey: "secret"}, errMsg: "missing access_key_id"},
+		{name: "missing secret key", credentials: Credentials{AccessKeyID: "AKIA"}, errMsg: "missing secret_access_key"},
+		{name: "session token only", credentials: Credentials{SessionToken: "token"}, errMsg: "missing access_key_id"},
+		{name: "static and profile", credentials: Credentials{AccessKeyID: "AKIA", SecretAccessKey: "secret", Profile: "garm"}, errMsg: "mutually exclusive"},
+		{name: "invalid role", credentials: Credentials{AssumeRole: AssumeRole{ExternalID: "garm"}}, errMsg: "assume_role: missing role_arn"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.credentials.Validate()
+			if tt.errMsg == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+				t.Fatalf("expected error containing %q, got %v", tt.errMsg, err)
+			}
+		})
+	}
+}
+
+func TestAssumeRoleValidate(t *testing.T) {
+	roleARN := "arn:aws:iam::123456789012:role/garm"
+	tests := []struct {
+		name       string
+		assumeRole AssumeRole
+		// errMsg is a substring the error must contain. Empty means success.
+		errMsg string
+	}{
+		{name: "disabled", assumeRole: AssumeRole{}},
+		{name: "role only", assumeRole: AssumeRole{RoleARN: roleARN}},
+		{name: "all options", assumeRole: AssumeRole{RoleARN: roleARN, ExternalID: "garm", SessionName: "garm-test", Duration: time.Hour}},
+		{name: "shortest duration", assumeRole: AssumeRole{RoleARN: roleARN, Duration: 15 * time.Minute}},
+		{name: "longest duration", assumeRole: AssumeRole{RoleARN: roleARN, Duration: 12 * time.Hour}},
+		{name: "external id without role", assumeRole: AssumeRole{ExternalID: "garm"}, errMsg: "missing role_arn"},
+		{name: "session name without role", assumeRole: AssumeRole{SessionName: "garm-test"}, errMsg: "missing role_arn"},
+		{name: "duration without role", assumeRole: AssumeRole{Duration: time.Hour}, errMsg: "missing role_arn"},
+		{name: "duration too short", assumeRole: AssumeRole{RoleARN: roleARN, Duration: 14 * time.Minute}, errMsg: "duration"},
+		{name: "duration too long", assumeRole: AssumeRole{RoleARN: roleARN, Duration: 13 * time.Hour}, errMsg: "duration"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.assumeRole.Validate()
+			if tt.errMsg == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+				t.Fatalf("expected error containing %q, got %v", tt.errMsg, err)
+			}
+		})
+	}
+}
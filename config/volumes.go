@@ -0,0 +1,233 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+)
+
+// dataVolumeDeviceRegex matches the device names EC2 accepts for additional
+// EBS volumes on both Linux and Windows.
+var dataVolumeDeviceRegex = regexp.MustCompile(`^(/dev/(sd|xvd)[b-z]|xvd[b-z])$`)
+
+// mountPathRegex limits mount paths to characters that are safe to use
+// unquoted in the generated userdata.
+var mountPathRegex = regexp.MustCompile(`^/[A-Za-z0-9._/-]+$`)
+
+// ebsLimits holds the limits of an EBS volume type.
+type ebsLimits struct {
+	minSizeGB, maxSizeGB int32
+	// IOPS limits. Zero max means IOPS cannot be set.
+	minIOPS, maxIOPS, maxIOPSPerGB int32
+	// IOPSRequired is true for provisioned IOPS volume types.
+	iopsRequired bool
+	// Throughput limits in MiB/s. Zero max means throughput cannot be set.
+	minThroughput, maxThroughput int32
+}
+
+var ebsVolumeLimits = map[string]ebsLimits{
+	"gp2":      {minSizeGB: 1, maxSizeGB: 16384},
+	"gp3":      {minSizeGB: 1, maxSizeGB: 16384, minIOPS: 3000, maxIOPS: 16000, maxIOPSPerGB: 500, minThroughput: 125, maxThroughput: 1000},
+	"io1":      {minSizeGB: 4, maxSizeGB: 16384, minIOPS: 100, maxIOPS: 64000, maxIOPSPerGB: 50, iopsRequired: true},
+	"io2":      {minSizeGB: 4, maxSizeGB: 65536, minIOPS: 100, maxIOPS: 256000, maxIOPSPerGB: 1000, iopsRequired: true},
+	"st1":      {minSizeGB: 125, maxSizeGB: 16384},
+	"sc1":      {minSizeGB: 125, maxSizeGB: 16384},
+	"standard": {minSizeGB: 1, maxSizeGB: 1024},
+}
+
+// EBSVolume configures an EBS volume attached to runners. It is used both in
+// the provider config and in the pool extra specs.
+type EBSVolume struct {
+	DeviceName          string `toml:"device_name" json:"device_name,omitempty" description:"Device name of a data volume, eg: /dev/sdf. Not used for the root volume." jsonschema:"pattern=^(/dev/(sd|xvd)[b-z]|xvd[b-z])$"`
+	SizeGB              int32  `toml:"size_gb" json:"size_gb,omitempty" description:"Size of the volume in GiB." jsonschema:"minimum=1"`
+	VolumeType          string `toml:"volume_type" json:"volume_type,omitempty" description:"EBS volume type. Defaults to gp3 for data volumes and to the type of the image for the root volume." jsonschema:"enum=gp2|gp3|io1|io2|st1|sc1|standard"`
+	IOPS                int32  `toml:"iops" json:"iops,omitempty" description:"Provisioned IOPS. Only valid for gp3, io1 and io2." jsonschema:"minimum=1"`
+	Throughput          int32  `toml:"throughput" json:"throughput,omitempty" description:"Throughput in MiB/s. Only valid for gp3." jsonschema:"minimum=1"`
+	Encrypted           *bool  `toml:"encrypted" json:"encrypted,omitempty" description:"Enable EBS encryption."`
+	KMSKeyID            string `toml:"kms_key_id" json:"kms_key_id,omitempty" description:"KMS key used for encryption. Requires encrypted."`
+	DeleteOnTermination *bool  `toml:"delete_on_termination" json:"delete_on_termination,omitempty" description:"Delete the volume when the runner is terminated. Defaults to true."`
+	// SnapshotID and SnapshotTags restore a data volume from an EBS snapshot,
+	// eg: a pre-warmed docker or toolcache volume.
+	SnapshotID   string            `toml:"snapshot_id" json:"snapshot_id,omitempty" description:"EBS snapshot the data volume is restored from." jsonschema:"pattern=^snap-[0-9a-f]{8,17}$"`
+	SnapshotTags map[string]string `toml:"snapshot_tags" json:"snapshot_tags,omitempty" description:"Restore the data volume from the most recent completed snapshot owned by the account with these tags." jsonschema:"maxProperties=10;keyMinLength=1;keyMaxLength=128;maxLength=256"`
+	// MountPath is where the userdata mounts a data volume. Volumes without a
+	// filesystem are formatted first.
+	MountPath string `toml:"mount_path" json:"mount_path,omitempty" description:"Path the data volume is mounted at by the runner userdata, eg: /var/lib/docker. Linux only." jsonschema:"pattern=^/[A-Za-z0-9._/-]+$"`
+}
+
+// IsZero returns true if no field of the volume is set.
+func (v EBSVolume) IsZero() bool {
+	return reflect.ValueOf(v).IsZero()
+}
+
+// HasSnapshot returns true if the volume is restored from a snapshot.
+func (v EBSVolume) HasSnapshot() bool {
+	return v.SnapshotID != "" || len(v.SnapshotTags) > 0
+}
+
+// Merge returns a copy of the volume with the fields set in override replacing
+// its own.
+func (v EBSVolume) Merge(override EBSVolume) EBSVolume {
+	if override.DeviceName != "" {
+		v.DeviceName = override.DeviceName
+	}
+	if override.SizeGB != 0 {
+		v.SizeGB = override.SizeGB
+	}
+	if override.VolumeType != "" {
+		v.VolumeType = override.VolumeType
+	}
+	if override.IOPS != 0 {
+		v.IOPS = override.IOPS
+	}
+	if override.Throughput != 0 {
+		v.Throughput = override.Throughput
+	}
+	if override.Encrypted != nil {
+		v.Encrypted = override.Encrypted
+	}
+	if override.KMSKeyID != "" {
+		v.KMSKeyID = override.KMSKeyID
+	}
+	if override.DeleteOnTermination != nil {
+		v.DeleteOnTermination = override.DeleteOnTermination
+	}
+	if override.HasSnapshot() {
+		v.SnapshotID = override.SnapshotID
+		v.SnapshotTags = override.SnapshotTags
+	}
+	if override.MountPath != "" {
+		v.MountPath = override.MountPath
+	}
+	return v
+}
+
+// ValidateRoot validates the volume as a root volume. A zero size keeps the
+// size of the image.
+func (v EBSVolume) ValidateRoot() error {
+	if v.DeviceName != "" {
+		return fmt.Errorf("device_name: the root device name is taken from the image")
+	}
+	if v.HasSnapshot() {
+		return fmt.Errorf("snapshot_id: the root volume is restored from the image")
+	}
+	if v.MountPath != "" {
+		return fmt.Errorf("mount_path: the root volume is mounted by the image")
+	}
+	// Without a volume type, the root volume keeps the type of the image,
+	// whose limits are unknown.
+	if v.VolumeType == "" && (v.IOPS != 0 || v.Throughput != 0) {
+		return fmt.Errorf("volume_type: required when setting iops or throughput")
+	}
+	return v.validateLimits()
+}
+
+// ValidateData validates the volume as an additional data volume.
+func (v EBSVolume) ValidateData() error {
+	if v.DeviceName == "" {
+		return fmt.Errorf("device_name: missing device name")
+	}
+	if !dataVolumeDeviceRegex.MatchString(v.DeviceName) {
+		return fmt.Errorf("device_name: invalid device name %q", v.DeviceName)
+	}
+	if v.SnapshotID != "" && len(v.SnapshotTags) > 0 {
+		return fmt.Errorf("snapshot_tags: cannot be used together with snapshot_id")
+	}
+	// Volumes restored from a snapshot default to the size of the snapshot.
+	if v.SizeGB == 0 && !v.HasSnapshot() {
+		return fmt.Errorf("size_gb: missing size")
+	}
+	if v.MountPath != "" && (!mountPathRegex.MatchString(v.MountPath) || v.MountPath == "/") {
+		return fmt.Errorf("mount_path: invalid mount path %q", v.MountPath)
+	}
+	return v.validateLimits()
+}
+
+// validateLimits checks the volume against the EBS limits of its type.
+func (v EBSVolume) validateLimits() error {
+	volumeType := v.VolumeType
+	if volumeType == "" {
+		volumeType = "gp3"
+	}
+	limits, ok := ebsVolumeLimits[volumeType]
+	if !ok {
+		return fmt.Errorf("volume_type: unknown volume type %q", v.VolumeType)
+	}
+
+	if v.SizeGB != 0 && (v.SizeGB < limits.minSizeGB || v.SizeGB > limits.maxSizeGB) {
+		return fmt.Errorf("size_gb: %s volumes must be between %d and %d GiB", volumeType, limits.minSizeGB, limits.maxSizeGB)
+	}
+
+	if v.IOPS != 0 {
+		if limits.maxIOPS == 0 {
+			return fmt.Errorf("iops: cannot be set for %s volumes", volumeType)
+		}
+		if v.IOPS < limits.minIOPS || v.IOPS > limits.maxIOPS {
+			return fmt.Errorf("iops: %s volumes support between %d and %d IOPS", volumeType, limits.minIOPS, limits.maxIOPS)
+		}
+		if v.SizeGB != 0 && v.IOPS > v.SizeGB*limits.maxIOPSPerGB {
+			return fmt.Errorf("iops: %s volumes support at most %d IOPS per GiB", volumeType, limits.maxIOPSPerGB)
+		}
+	} else if limits.iopsRequired {
+		return fmt.Errorf("iops: required for %s volumes", volumeType)
+	}
+
+	if v.Throughput != 0 {
+		if limits.maxThroughput == 0 {
+			return fmt.Errorf("throughput: cannot be set for %s volumes", volumeType)
+		}
+		if v.Throughput < limits.minThroughput || v.Throughput > limits.maxThroughput {
+			return fmt.Errorf("throughput: %s volumes support between %d and %d MiB/s", volumeType, limits.minThroughput, limits.maxThroughput)
+		}
+		// gp3 allows at most 0.25 MiB/s per provisioned IOPS.
+		iops := v.IOPS
+		if iops == 0 {
+			iops = limits.minIOPS
+		}
+		if v.Throughput*4 > iops {
+			return fmt.Errorf("throughput: at most 0.25 MiB/s per IOPS is allowed")
+		}
+	}
+
+	if v.KMSKeyID != "" && (v.Encrypted == nil || !*v.Encrypted) {
+		return fmt.Errorf("kms_key_id: requires encrypted to be true")
+	}
+	return nil
+}
+
+// ValidateDataVolumes validates a list of data volumes, including that their
+// device names and mount paths are unique.
+func ValidateDataVolumes(volumes []EBSVolume) error {
+	seen := map[string]bool{}
+	mounts := map[string]bool{}
+	for idx, volume := range volumes {
+		if err := volume.ValidateData(); err != nil {
+			return fmt.Errorf("data_volumes[%d].%w", idx, err)
+		}
+		if seen[volume.DeviceName] {
+			return fmt.Errorf("data_volumes[%d].device_name: duplicate device name %s", idx, volume.DeviceName)
+		}
+		seen[volume.DeviceName] = true
+		if volume.MountPath != "" {
+			if mounts[volume.MountPath] {
+				return fmt.Errorf("data_volumes[%d].mount_path: duplicate mount path %s", idx, volume.MountPath)
+			}
+			mounts[volume.MountPath] = true
+		}
+	}
+	return nil
+}
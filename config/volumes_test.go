@@ -0,0 +1,156 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEBSVolumeValidateRoot(t *testing.T) {
+	encrypted := true
+	tests := []struct {
+		name   string
+		volume EBSVolume
+		// errField is a substring the error must contain. Empty means success.
+		errField string
+	}{
+		{name: "empty", volume: EBSVolume{}},
+		{name: "gp3", volume: EBSVolume{SizeGB: 100, VolumeType: "gp3", IOPS: 6000, Throughput: 500}},
+		{name: "io2", volume: EBSVolume{SizeGB: 100, VolumeType: "io2", IOPS: 64000}},
+		{name: "encrypted", volume: EBSVolume{Encrypted: &encrypted, KMSKeyID: "alias/garm"}},
+		{name: "device name", volume: EBSVolume{DeviceName: "/dev/sdf"}, errField: "device_name"},
+		{name: "unknown type", volume: EBSVolume{VolumeType: "gp4"}, errField: "volume_type"},
+		{name: "standard too large", volume: EBSVolume{SizeGB: 2048, VolumeType: "standard"}, errField: "size_gb"},
+		{name: "st1 too small", volume: EBSVolume{SizeGB: 100, VolumeType: "st1"}, errField: "size_gb"},
+		{name: "iops on gp2", volume: EBSVolume{VolumeType: "gp2", IOPS: 3000}, errField: "iops"},
+		{name: "gp3 iops too high", volume: EBSVolume{VolumeType: "gp3", IOPS: 20000}, errField: "iops"},
+		{name: "gp3 iops per GiB", volume: EBSVolume{SizeGB: 8, VolumeType: "gp3", IOPS: 6000}, errField: "iops"},
+		{name: "io1 without iops", volume: EBSVolume{SizeGB: 100, VolumeType: "io1"}, errField: "iops"},
+		{name: "io1 iops per GiB", volume: EBSVolume{SizeGB: 10, VolumeType: "io1", IOPS: 1000}, errField: "iops"},
+		{name: "throughput on io2", volume: EBSVolume{VolumeType: "io2", IOPS: 1000, Throughput: 200}, errField: "throughput"},
+		{name: "throughput per iops", volume: EBSVolume{VolumeType: "gp3", Throughput: 1000}, errField: "throughput"},
+		{name: "kms without encryption", volume: EBSVolume{KMSKeyID: "alias/garm"}, errField: "kms_key_id"},
+		{name: "snapshot", volume: EBSVolume{SnapshotID: "snap-0123456789abcdef0"}, errField: "snapshot_id"},
+		{name: "mount path", volume: EBSVolume{MountPath: "/data"}, errField: "mount_path"},
+		{name: "iops without type", volume: EBSVolume{SizeGB: 100, IOPS: 4000}, errField: "volume_type"},
+		{name: "throughput without type", volume: EBSVolume{SizeGB: 100, Throughput: 250}, errField: "volume_type"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.volume.ValidateRoot()
+			if tt.errField == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), tt.errField+":") {
+				t.Fatalf("expected error for %s, got %v", tt.errField, err)
+			}
+		})
+	}
+}
+
+func TestValidateDataVolumes(t *testing.T) {
+	tests := []struct {
+		name    string
+		volumes []EBSVolume
+		// errField is a substring the error must contain. Empty means success.
+		errField string
+	}{
+		{name: "none"},
+		{
+			name:    "valid",
+			volumes: []EBSVolume{{DeviceName: "/dev/sdf", SizeGB: 100}, {DeviceName: "xvdg", SizeGB: 500, VolumeType: "st1"}},
+		},
+		{
+			name:     "missing device name",
+			volumes:  []EBSVolume{{SizeGB: 100}},
+			errField: "data_volumes[0].device_name",
+		},
+		{
+			name:     "root device name",
+			volumes:  []EBSVolume{{DeviceName: "/dev/sda1", SizeGB: 100}},
+			errField: "data_volumes[0].device_name",
+		},
+		{
+			name:     "missing size",
+			volumes:  []EBSVolume{{DeviceName: "/dev/sdf"}},
+			errField: "data_volumes[0].size_gb",
+		},
+		{
+			name:     "duplicate device name",
+			volumes:  []EBSVolume{{DeviceName: "/dev/sdf", SizeGB: 100}, {DeviceName: "/dev/sdf", SizeGB: 100}},
+			errField: "data_volumes[1].device_name",
+		},
+		{
+			name:    "snapshot without size",
+			volumes: []EBSVolume{{DeviceName: "/dev/sdf", SnapshotTags: map[string]string{"cache": "docker"}, MountPath: "/var/lib/docker"}},
+		},
+		{
+			name:     "snapshot id and tags",
+			volumes:  []EBSVolume{{DeviceName: "/dev/sdf", SnapshotID: "snap-0123456789abcdef0", SnapshotTags: map[string]string{"cache": "docker"}}},
+			errField: "data_volumes[0].snapshot_tags",
+		},
+		{
+			name:     "invalid mount path",
+			volumes:  []EBSVolume{{DeviceName: "/dev/sdf", SizeGB: 100, MountPath: "/var/lib/docker; reboot"}},
+			errField: "data_volumes[0].mount_path",
+		},
+		{
+			name:     "duplicate mount path",
+			volumes:  []EBSVolume{{DeviceName: "/dev/sdf", SizeGB: 100, MountPath: "/data"}, {DeviceName: "/dev/sdg", SizeGB: 100, MountPath: "/data"}},
+			errField: "data_volumes[1].mount_path",
+		},
+		{
+			name:     "limits",
+			volumes:  []EBSVolume{{DeviceName: "/dev/sdf", SizeGB: 100, VolumeType: "io2"}},
+			errField: "data_volumes[0].iops",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateDataVolumes(tt.volumes)
+			if tt.errField == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.errField) {
+				t.Fatalf("expected error mentioning %s, got %v", tt.errField, err)
+			}
+		})
+	}
+}
+
+func TestEBSVolumeMerge(t *testing.T) {
+	encrypted := true
+	base := EBSVolume{SizeGB: 50, VolumeType: "gp3", Encrypted: &encrypted, KMSKeyID: "alias/garm"}
+	merged := base.Merge(EBSVolume{SizeGB: 100, IOPS: 4000})
+
+	if merged.SizeGB != 100 || merged.IOPS != 4000 {
+		t.Fatalf("override not applied: %+v", merged)
+	}
+	if merged.VolumeType != "gp3" || merged.KMSKeyID != "alias/garm" || merged.Encrypted == nil {
+		t.Fatalf("base fields lost: %+v", merged)
+	}
+	if base.SizeGB != 50 {
+		t.Fatalf("base volume was modified: %+v", base)
+	}
+}
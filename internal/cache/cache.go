@@ -0,0 +1,183 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+// Package cache persists small pieces of state between provider invocations.
+// GARM runs the provider as a new process for every operation, so anything
+// worth remembering has to live on disk.
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// entry is a cached value with its expiry.
+type entry struct {
+	Expires time.Time       `json:"expires"`
+	Value   json.RawMessage `json:"value"`
+}
+
+const (
+	// lockTimeout is how long we wait for another process to release the
+	// lock of a cache file.
+	lockTimeout = 10 * time.Second
+	// lockRetryInterval is how often a held lock is retried.
+	lockRetryInterval = 50 * time.Millisecond
+)
+
+// Cache stores JSON encoded values in files under a directory. Each file
+// holds a set of keyed entries that expire independently. Writes hold an
+// exclusive lock on the file, so concurrent provider processes do not lose
+// each other's updates.
+type Cache struct {
+	dir string
+}
+
+// New returns a cache storing its files in dir. The directory is created on
+// the first write.
+func New(dir string) *Cache {
+	return &Cache{dir: dir}
+}
+
+// Load decodes the unexpired entry stored under key in the named file into
+// v. It returns false if there is no such entry.
+func (c *Cache) Load(name, key string, v interface{}) (bool, error) {
+	entries, err := c.read(name)
+	if err != nil {
+		return false, err
+	}
+	e, ok := entries[key]
+	if !ok || time.Now().After(e.Expires) {
+		return false, nil
+	}
+	if err := json.Unmarshal(e.Value, v); err != nil {
+		return false, fmt.Errorf("failed to decode cache entry %s: %w", key, err)
+	}
+	return true, nil
+}
+
+// Store saves v under key in the named file for ttl. Expired entries of the
+// file are dropped.
+func (c *Cache) Store(name, key string, v interface{}, ttl time.Duration) error {
+	return c.modify(name, func(entries map[string]entry) error {
+		return setEntry(entries, key, v, ttl)
+	})
+}
+
+// Update atomically replaces the entry stored under key in the named file.
+// The current entry is decoded into v, which is left untouched if there is
+// none, then update is called and v is stored for ttl.
+func (c *Cache) Update(name, key string, v interface{}, ttl time.Duration, update func() error) error {
+	return c.modify(name, func(entries map[string]entry) error {
+		if e, ok := entries[key]; ok {
+			if err := json.Unmarshal(e.Value, v); err != nil {
+				return fmt.Errorf("failed to decode cache entry %s: %w", key, err)
+			}
+		}
+		if err := update(); err != nil {
+			return err
+		}
+		return setEntry(entries, key, v, ttl)
+	})
+}
+
+func setEntry(entries map[string]entry, key string, v interface{}, ttl time.Duration) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode cache entry %s: %w", key, err)
+	}
+	entries[key] = entry{
+		Expires: time.Now().Add(ttl),
+		Value:   value,
+	}
+	return nil
+}
+
+// modify runs fn on the unexpired entries of the named file and writes the
+// result back, holding the lock of the file.
+func (c *Cache) modify(name string, fn func(map[string]entry) error) error {
+	if err := os.MkdirAll(c.dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create cache dir: %w", err)
+	}
+	unlock, err := lockFile(c.path(name) + ".lock")
+	if err != nil {
+		return fmt.Errorf("failed to lock cache %s: %w", name, err)
+	}
+	defer unlock()
+
+	entries, err := c.read(name)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for k, e := range entries {
+		if now.After(e.Expires) {
+			delete(entries, k)
+		}
+	}
+	if err := fn(entries); err != nil {
+		return err
+	}
+	return c.write(name, entries)
+}
+
+func (c *Cache) path(name string) string {
+	return filepath.Join(c.dir, name+".json")
+}
+
+func (c *Cache) read(name string) (map[string]entry, error) {
+	entries := map[string]entry{}
+	data, err := os.ReadFile(c.path(name))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return entries, nil
+		}
+		return nil, fmt.Errorf("failed to read cache %s: %w", name, err)
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		// A corrupt cache is not worth failing over. Start over.
+		return map[string]entry{}, nil
+	}
+	return entries, nil
+}
+
+// write replaces the named file atomically, so concurrent readers never see
+// a partially written file.
+func (c *Cache) write(name string, entries map[string]entry) error {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("failed to encode cache %s: %w", name, err)
+	}
+
+	tmp, err := os.CreateTemp(c.dir, name+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write cache %s: %w", name, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write cache %s: %w", name, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write cache %s: %w", name, err)
+	}
+	if err := os.Rename(tmp.Name(), c.path(name)); err != nil {
+		return fmt.Errorf("failed to write cache %s: %w", name, err)
+	}
+	return nil
+}
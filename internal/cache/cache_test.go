@@ -0,0 +1,109 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCacheStoreAndLoad(t *testing.T) {
+	c := New(filepath.Join(t.TempDir(), "cache"))
+
+	var missing []string
+	if found, err := c.Load("types", "key", &missing); err != nil || found {
+		t.Fatalf("expected no entry in an empty cache, got %v %v", found, err)
+	}
+
+	expected := []string{"m7i.large", "m6i.large"}
+	if err := c.Store("types", "key", expected, time.Hour); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.Store("types", "expired", expected, -time.Second); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var loaded []string
+	found, err := c.Load("types", "key", &loaded)
+	if err != nil || !found {
+		t.Fatalf("expected cached entry, got %v %v", found, err)
+	}
+	if !reflect.DeepEqual(loaded, expected) {
+		t.Fatalf("expected %v, got %v", expected, loaded)
+	}
+
+	if found, err := c.Load("types", "expired", &loaded); err != nil || found {
+		t.Fatalf("expected expired entry to be ignored, got %v %v", found, err)
+	}
+	if found, err := c.Load("other", "key", &loaded); err != nil || found {
+		t.Fatalf("expected entries to be scoped to their file, got %v %v", found, err)
+	}
+}
+
+func TestCacheIgnoresCorruptFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "types.json"), []byte("{not json"), 0o600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	c := New(dir)
+	var loaded []string
+	if found, err := c.Load("types", "key", &loaded); err != nil || found {
+		t.Fatalf("expected corrupt cache to be treated as empty, got %v %v", found, err)
+	}
+	if err := c.Store("types", "key", []string{"m7i.large"}, time.Hour); err != nil {
+		t.Fatalf("expected corrupt cache to be replaced, got %v", err)
+	}
+	if found, err := c.Load("types", "key", &loaded); err != nil || !found {
+		t.Fatalf("expected cached entry, got %v %v", found, err)
+	}
+}
+
+func TestCacheUpdateIsAtomic(t *testing.T) {
+	dir := t.TempDir()
+
+	const writers = 20
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Separate caches open the lock file separately, like
+			// separate provider processes do.
+			c := New(dir)
+			var counter int
+			err := c.Update("counters", "key", &counter, time.Hour, func() error {
+				counter++
+				return nil
+			})
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var counter int
+	if found, err := New(dir).Load("counters", "key", &counter); err != nil || !found {
+		t.Fatalf("expected cached entry, got %v %v", found, err)
+	}
+	if counter != writers {
+		t.Fatalf("expected %d updates, got %d", writers, counter)
+	}
+}
@@ -16,44 +16,88 @@ package client
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
 	"github.com/cloudbase/garm-provider-aws/config"
+	"github.com/cloudbase/garm-provider-aws/internal/cache"
+	"github.com/cloudbase/garm-provider-aws/internal/convert"
 	"github.com/cloudbase/garm-provider-aws/internal/spec"
+	"github.com/cloudbase/garm-provider-aws/internal/util"
+	garmErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-common/params"
 )
 
-func NewAwsCli(cfg *config.Config) (*AwsCli, error) {
-	creds, err := cfg.Credentials.GetCredentials()
+const (
+	// maxTerminateBatchSize is the maximum number of instance IDs accepted by a
+	// single TerminateInstances call.
+	maxTerminateBatchSize = 1000
+	// maxParallelTerminateBatches bounds the number of concurrent
+	// TerminateInstances batches.
+	maxParallelTerminateBatches = 4
+	// defaultTerminateTimeout is how long we wait for instances to terminate
+	// when the context has no deadline.
+	defaultTerminateTimeout = 10 * time.Minute
+	// terminateCheckTimeout bounds the lookup of the instances that did not
+	// terminate in time.
+	terminateCheckTimeout = 30 * time.Second
+	// launchGenerationTTL is how long the launch generation of a runner is
+	// kept. It outlives the idempotency of the client tokens by far.
+	launchGenerationTTL = 30 * 24 * time.Hour
+)
+
+// activeInstanceStates are all instance states except terminated.
+var activeInstanceStates = []string{
+	string(types.InstanceStateNamePending),
+	string(types.InstanceStateNameRunning),
+	string(types.InstanceStateNameShuttingDown),
+	string(types.InstanceStateNameStopping),
+	string(types.InstanceStateNameStopped),
+}
+
+// spotFallbackErrorCodes are the RunInstances errors on which a spot launch
+// is retried on on-demand capacity, if the pool allows it.
+var spotFallbackErrorCodes = []string{
+	"InsufficientInstanceCapacity",
+	"SpotMaxPriceTooLow",
+}
+
+func NewAwsCli(ctx context.Context, cfg *config.Config, controllerID string) (*AwsCli, error) {
+	awsCfg, err := cfg.GetAWSConfig(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get credentials: %w", err)
-	}
-	//TODO: Add credentials in format that ec2.Options accepts
-	opts := ec2.Options{
-		Region:      cfg.Region,
-		Credentials: nil,
+		return nil, fmt.Errorf("failed to get AWS config: %w", err)
 	}
 
-	client := ec2.New(opts)
+	client := ec2.NewFromConfig(awsCfg)
 
 	awsCli := &AwsCli{
-		cfg:    cfg,
-		cred:   creds,
-		client: *client,
-		region: cfg.Region,
+		cfg:          cfg,
+		client:       *client,
+		region:       cfg.Region,
+		controllerID: controllerID,
+		cache:        cache.New(cfg.CacheDir),
 	}
 
 	return awsCli, nil
 }
 
 type AwsCli struct {
-	cfg  *config.Config
-	cred aws.Credentials
+	cfg *config.Config
 
-	client ec2.Client
-	region string
+	client       ec2.Client
+	region       string
+	controllerID string
+	cache        *cache.Cache
 }
 
 func (a *AwsCli) StartInstance(ctx context.Context, vmName string) error {
@@ -61,178 +105,533 @@ func (a *AwsCli) StartInstance(ctx context.Context, vmName string) error {
 		InstanceIds: []string{vmName},
 	})
 	if err != nil {
-		return fmt.Errorf("failed to start instance: %w", err)
+		return fmt.Errorf("failed to start instance: %w", classifyError(err))
 	}
 
 	return nil
 }
 
-func (a *AwsCli) StopInstance(ctx context.Context, vmName string) error {
-	_, err := a.client.StopInstances(ctx, &ec2.StopInstancesInput{
+// StopInstance stops the instance, or hibernates it if hibernate is set. Force
+// is ignored when hibernating, as a forced stop skips writing RAM to disk.
+func (a *AwsCli) StopInstance(ctx context.Context, vmName string, force, hibernate bool) error {
+	input := &ec2.StopInstancesInput{
 		InstanceIds: []string{vmName},
+	}
+	if hibernate {
+		input.Hibernate = aws.Bool(true)
+	} else {
 		// Forces the instances to stop. The instances do not have an opportunity to flush
 		// file system caches or file system metadata. If you use this option, you must
 		// perform file system check and repair procedures. This option is not recommended
 		// for Windows instances. Default: false
-		//Force:       force,
-	})
+		input.Force = aws.Bool(force)
+	}
+
+	_, err := a.client.StopInstances(ctx, input)
 	if err != nil {
-		return fmt.Errorf("failed to stop instance: %w", err)
+		return fmt.Errorf("failed to stop instance: %w", classifyError(err))
 	}
 
 	return nil
 }
 
-// TODO: Find better way to get instance without the Instance struct
-func (a *AwsCli) GetInstance(ctx context.Context, vmName string) (*types.Instance, error) {
+// instanceIDRegex matches EC2 instance IDs, as opposed to runner names.
+var instanceIDRegex = regexp.MustCompile(`^i-[0-9a-f]{8,17}$`)
+
+// instanceIDPattern finds EC2 instance IDs in error messages.
+var instanceIDPattern = regexp.MustCompile(`i-[0-9a-f]{8,17}`)
+
+// GetInstance returns the instance with the given EC2 instance ID. An error
+// wrapping ErrNotFound is returned if the instance does not exist.
+func (a *AwsCli) GetInstance(ctx context.Context, instanceID string) (*types.Instance, error) {
 	resp, err := a.client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
-		InstanceIds: []string{vmName},
+		InstanceIds: []string{instanceID},
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get instance: %w", err)
+		if isAPIErrorCode(err, "InvalidInstanceID.NotFound", "InvalidInstanceID.Malformed") {
+			return nil, fmt.Errorf("instance %s: %w", instanceID, garmErrors.ErrNotFound)
+		}
+		return nil, fmt.Errorf("failed to get instance: %w", classifyError(err))
 	}
 
 	if len(resp.Reservations) == 0 || len(resp.Reservations[0].Instances) == 0 {
-		return nil, fmt.Errorf("instance not found")
+		return nil, fmt.Errorf("instance %s: %w", instanceID, garmErrors.ErrNotFound)
 	}
 
 	return &resp.Reservations[0].Instances[0], nil
 }
 
+// WaitForInstanceState waits up to timeout for the instance to reach the
+// running, stopped or terminated state and returns the instance as last seen.
+func (a *AwsCli) WaitForInstanceState(ctx context.Context, instanceID string, state types.InstanceStateName, timeout time.Duration) (*types.Instance, error) {
+	input := &ec2.DescribeInstancesInput{
+		InstanceIds: []string{instanceID},
+	}
+
+	var (
+		resp *ec2.DescribeInstancesOutput
+		err  error
+	)
+	switch state {
+	case types.InstanceStateNameRunning:
+		resp, err = ec2.NewInstanceRunningWaiter(&a.client).WaitForOutput(ctx, input, timeout)
+	case types.InstanceStateNameStopped:
+		resp, err = ec2.NewInstanceStoppedWaiter(&a.client).WaitForOutput(ctx, input, timeout)
+	case types.InstanceStateNameTerminated:
+		resp, err = ec2.NewInstanceTerminatedWaiter(&a.client).WaitForOutput(ctx, input, timeout)
+	default:
+		return nil, fmt.Errorf("cannot wait for instance state %s", state)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed waiting for instance %s to be %s: %w", instanceID, state, classifyError(err))
+	}
+
+	if len(resp.Reservations) == 0 || len(resp.Reservations[0].Instances) == 0 {
+		return nil, fmt.Errorf("instance %s: %w", instanceID, garmErrors.ErrNotFound)
+	}
+	return &resp.Reservations[0].Instances[0], nil
+}
+
+// ResolveInstance returns the instance identified either by its EC2 instance
+// ID or by its runner name. GARM uses the runner name for instances whose
+// create never returned a provider ID. An error wrapping ErrNotFound is
+// returned if nothing matches.
+func (a *AwsCli) ResolveInstance(ctx context.Context, instance string) (*types.Instance, error) {
+	if instanceIDRegex.MatchString(instance) {
+		return a.GetInstance(ctx, instance)
+	}
+
+	found, err := a.FindInstanceByName(ctx, instance)
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, fmt.Errorf("instance %s: %w", instance, garmErrors.ErrNotFound)
+	}
+	return found, nil
+}
+
 // You can stop, start, and terminate EBS-backed instances. You can only terminate instance store-backed instances. What happens to an instance differs if you stop it or terminate it. For example, when you stop an instance, the root device and any other devices attached to the instance persist. When you terminate an instance, any attached EBS volumes with the DeleteOnTermination block device mapping parameter set to true are automatically deleted.
 func (a *AwsCli) TerminateInstance(ctx context.Context, vmName string) error {
+	if err := a.prepareTermination(ctx, []string{vmName}); err != nil {
+		return err
+	}
+
 	_, err := a.client.TerminateInstances(ctx, &ec2.TerminateInstancesInput{
 		InstanceIds: []string{vmName},
 	})
 	if err != nil {
-		return fmt.Errorf("failed to terminate instance: %w", err)
+		return fmt.Errorf("failed to terminate instance: %w", classifyError(err))
 	}
 
 	return nil
 }
 
-// TODO: find better method to get all instances
-func (a *AwsCli) ListDescribedInstances(ctx context.Context, poolID string) ([]types.Instance, error) {
-	resp, err := a.client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{})
-	if err != nil {
-		return nil, fmt.Errorf("failed to get instance: %w", err)
+// TerminateInstances terminates the given instances in batches and waits for
+// them to reach the terminated state. Instances that could not be terminated
+// are reported in the returned error.
+func (a *AwsCli) TerminateInstances(ctx context.Context, instanceIDs []string) error {
+	var batches [][]string
+	for start := 0; start < len(instanceIDs); start += maxTerminateBatchSize {
+		end := min(start+maxTerminateBatchSize, len(instanceIDs))
+		batches = append(batches, instanceIDs[start:end])
 	}
 
-	var instances []types.Instance
-	for _, reservation := range resp.Reservations {
-		instances = append(instances, reservation.Instances...)
+	var (
+		wg   sync.WaitGroup
+		mux  sync.Mutex
+		errs []error
+		sem  = make(chan struct{}, maxParallelTerminateBatches)
+	)
+	for _, batch := range batches {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(batch []string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if failed, err := a.terminateAndWait(ctx, batch); err != nil {
+				mux.Lock()
+				errs = append(errs, fmt.Errorf("instances %s: %w", strings.Join(failed, ", "), err))
+				mux.Unlock()
+			}
+		}(batch)
 	}
+	wg.Wait()
 
-	return instances, nil
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to terminate instances: %w", errors.Join(errs...))
+	}
+	return nil
 }
 
-// Used to get IGW ID for VPC
-func (a *AwsCli) CreateInternetGateway(ctx context.Context) (string, error) {
-	resp, err := a.client.CreateInternetGateway(ctx, &ec2.CreateInternetGatewayInput{})
-	if err != nil {
-		return "", fmt.Errorf("failed to create internet gateway: %w", err)
+// terminateAndWait terminates the instances and waits for them to reach the
+// terminated state. On error, it returns the instances that failed.
+// Instances that no longer exist are skipped.
+func (a *AwsCli) terminateAndWait(ctx context.Context, instanceIDs []string) ([]string, error) {
+	remaining := instanceIDs
+	for len(remaining) > 0 {
+		if err := a.prepareTermination(ctx, remaining); err != nil {
+			return remaining, err
+		}
+
+		_, err := a.client.TerminateInstances(ctx, &ec2.TerminateInstancesInput{
+			InstanceIds: remaining,
+		})
+		if err == nil {
+			break
+		}
+		// A single missing instance fails the whole call. Drop the missing
+		// ones and terminate the rest.
+		missing := missingInstanceIDs(err, remaining)
+		if len(missing) == 0 {
+			return remaining, fmt.Errorf("failed to terminate instances: %w", classifyError(err))
+		}
+		remaining = slices.DeleteFunc(slices.Clone(remaining), func(id string) bool {
+			return slices.Contains(missing, id)
+		})
+	}
+	if len(remaining) == 0 {
+		return nil, nil
 	}
 
-	//Tag the internet gateway with GARM-IGW tag
-	_, err = a.client.CreateTags(ctx, &ec2.CreateTagsInput{
-		Resources: []string{*resp.InternetGateway.InternetGatewayId},
-		Tags: []types.Tag{
+	timeout := defaultTerminateTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+		if timeout <= 0 {
+			return remaining, fmt.Errorf("failed waiting for instances to terminate: %w", context.DeadlineExceeded)
+		}
+	}
+
+	waiter := ec2.NewInstanceTerminatedWaiter(&a.client)
+	if err := waiter.Wait(ctx, &ec2.DescribeInstancesInput{InstanceIds: remaining}, timeout); err != nil {
+		waitErr := fmt.Errorf("failed waiting for instances to terminate: %w", classifyError(err))
+		// The wait usually ends with the deadline of ctx, so the instances
+		// are checked with a context of their own.
+		checkCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), terminateCheckTimeout)
+		defer cancel()
+		failed, err := a.unterminatedInstances(checkCtx, remaining)
+		if err != nil {
+			return remaining, errors.Join(waitErr, err)
+		}
+		if len(failed) == 0 {
+			return nil, nil
+		}
+		return failed, waitErr
+	}
+	return nil, nil
+}
+
+// missingInstanceIDs returns the instances an InvalidInstanceID.NotFound
+// error reports as missing. EC2 only lists them in the error message.
+func missingInstanceIDs(err error, instanceIDs []string) []string {
+	var apiErr smithy.APIError
+	if !isAPIErrorCode(err, "InvalidInstanceID.NotFound") || !errors.As(err, &apiErr) {
+		return nil
+	}
+
+	var missing []string
+	for _, id := range instanceIDPattern.FindAllString(apiErr.ErrorMessage(), -1) {
+		if slices.Contains(instanceIDs, id) && !slices.Contains(missing, id) {
+			missing = append(missing, id)
+		}
+	}
+	return missing
+}
+
+// unterminatedInstances returns the instances that are not terminated yet.
+// Instances that no longer exist count as terminated.
+func (a *AwsCli) unterminatedInstances(ctx context.Context, instanceIDs []string) ([]string, error) {
+	var ids []string
+	paginator := ec2.NewDescribeInstancesPaginator(&a.client, &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{
+			{
+				Name:   aws.String("instance-id"),
+				Values: instanceIDs,
+			},
 			{
-				Key:   aws.String("Name"),
-				Value: aws.String("GARM-IGW"),
+				Name:   aws.String("instance-state-name"),
+				Values: activeInstanceStates,
 			},
 		},
 	})
-	if err != nil {
-		return "", fmt.Errorf("failed to tag internet gateway: %w", err)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe instances: %w", classifyError(err))
+		}
+		for _, reservation := range page.Reservations {
+			for _, instance := range reservation.Instances {
+				ids = append(ids, aws.ToString(instance.InstanceId))
+			}
+		}
 	}
-	return *resp.InternetGateway.InternetGatewayId, nil
+	return ids, nil
 }
 
-// Used to get VPC ID
-func (a *AwsCli) CreateVpc(ctx context.Context, cidr string) (string, error) {
-	resp, err := a.client.CreateVpc(ctx, &ec2.CreateVpcInput{
-		CidrBlock: aws.String(cidr),
+// prepareTermination cancels the spot requests the instances were launched
+// from and advances the launch generation of their runners. Runners that
+// stop or hibernate on interruption come from persistent requests, which
+// would otherwise launch a replacement once the instance is terminated.
+func (a *AwsCli) prepareTermination(ctx context.Context, instanceIDs []string) error {
+	resp, err := a.client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: instanceIDs,
 	})
 	if err != nil {
-		return "", fmt.Errorf("failed to create VPC: %w", err)
+		if isAPIErrorCode(err, "InvalidInstanceID.NotFound") {
+			// Let TerminateInstances report the missing instances.
+			return nil
+		}
+		return fmt.Errorf("failed to describe instances: %w", classifyError(err))
 	}
 
-	//Tag the VPC with GARM-VPC tag
-	_, err = a.client.CreateTags(ctx, &ec2.CreateTagsInput{
-		Resources: []string{*resp.Vpc.VpcId},
-		Tags: []types.Tag{
-			{
-				Key:   aws.String("Name"),
-				Value: aws.String("GARM-VPC"),
-			},
-		},
+	var requestIDs []string
+	for _, reservation := range resp.Reservations {
+		for _, instance := range reservation.Instances {
+			if instance.SpotInstanceRequestId != nil {
+				requestIDs = append(requestIDs, aws.ToString(instance.SpotInstanceRequestId))
+			}
+			if name := instanceTag(instance, util.NameTagName); name != "" {
+				a.advanceLaunchGeneration(name)
+			}
+		}
+	}
+	if len(requestIDs) == 0 {
+		return nil
+	}
+
+	_, err = a.client.CancelSpotInstanceRequests(ctx, &ec2.CancelSpotInstanceRequestsInput{
+		SpotInstanceRequestIds: requestIDs,
 	})
-	if err != nil {
-		return "", fmt.Errorf("failed to tag VPC: %w", err)
+	if err != nil && !isAPIErrorCode(err, "InvalidSpotInstanceRequestID.NotFound") {
+		return fmt.Errorf("failed to cancel spot requests: %w", classifyError(err))
+	}
+	return nil
+}
+
+func instanceTag(instance types.Instance, key string) string {
+	for _, tag := range instance.Tags {
+		if aws.ToString(tag.Key) == key {
+			return aws.ToString(tag.Value)
+		}
+	}
+	return ""
+}
+
+// launchGeneration returns the number of instances of the runner the
+// provider terminated. EC2 answers a launch with a known client token with
+// the instance it launched before, even if that instance is gone, so the
+// generation is part of the client token of the runner.
+func (a *AwsCli) launchGeneration(name string) int {
+	var generation int
+	if _, err := a.cache.Load("launch-generations", a.controllerID+"/"+name, &generation); err != nil {
+		log.Printf("failed to load launch generation of %s: %s", name, err)
 	}
-	return *resp.Vpc.VpcId, nil
+	return generation
 }
 
-// Attach IGW to VPC
-func (a *AwsCli) AttachInternetGateway(ctx context.Context, igwID, vpcID string) error {
-	_, err := a.client.AttachInternetGateway(ctx, &ec2.AttachInternetGatewayInput{
-		InternetGatewayId: aws.String(igwID),
-		VpcId:             aws.String(vpcID),
+func (a *AwsCli) advanceLaunchGeneration(name string) {
+	var generation int
+	err := a.cache.Update("launch-generations", a.controllerID+"/"+name, &generation, launchGenerationTTL, func() error {
+		generation++
+		return nil
 	})
 	if err != nil {
-		return fmt.Errorf("failed to attach internet gateway: %w", err)
+		log.Printf("failed to advance launch generation of %s: %s", name, err)
 	}
-	return nil
 }
 
-//TODO: Create route for GW  and VPC?
+// ListControllerInstances returns all non-terminated instances belonging to
+// this controller, regardless of pool.
+func (a *AwsCli) ListControllerInstances(ctx context.Context) ([]types.Instance, error) {
+	return a.describeControllerInstances(ctx, nil)
+}
 
-// Create subnet
-func (a *AwsCli) CreateSubnet(ctx context.Context, vpcID string, cidr string, region string) (string, error) {
-	resp, err := a.client.CreateSubnet(ctx, &ec2.CreateSubnetInput{
-		CidrBlock:        aws.String(cidr),
-		VpcId:            aws.String(vpcID),
-		AvailabilityZone: aws.String(region),
+// FindInstanceByName returns the instance of this controller with the given
+// runner name that is not being terminated, or nil if there is none.
+func (a *AwsCli) FindInstanceByName(ctx context.Context, name string) (*types.Instance, error) {
+	instances, err := a.describeControllerInstances(ctx, []types.Filter{
+		{
+			Name:   aws.String("tag:" + util.NameTagName),
+			Values: []string{name},
+		},
 	})
 	if err != nil {
-		return "", fmt.Errorf("failed to create subnet: %w", err)
+		return nil, fmt.Errorf("failed to find instance %s: %w", name, err)
+	}
+	for idx, instance := range instances {
+		if instance.State != nil && instance.State.Name == types.InstanceStateNameShuttingDown {
+			continue
+		}
+		return &instances[idx], nil
 	}
+	return nil, nil
+}
 
-	//Tag the subnet with GARM-SUBNET tag
-	_, err = a.client.CreateTags(ctx, &ec2.CreateTagsInput{
-		Resources: []string{*resp.Subnet.SubnetId},
-		Tags: []types.Tag{
-			{
-				Key:   aws.String("Name"),
-				Value: aws.String("GARM-SUBNET"),
-			},
+// ListDescribedInstances returns all non-terminated instances belonging to this
+// controller and the given pool.
+func (a *AwsCli) ListDescribedInstances(ctx context.Context, poolID string) ([]types.Instance, error) {
+	filters := []types.Filter{
+		{
+			Name:   aws.String("tag:" + util.PoolIDTagName),
+			Values: []string{poolID},
+		},
+	}
+
+	return a.describeControllerInstances(ctx, filters)
+}
+
+// describeControllerInstances returns all non-terminated instances tagged with
+// this controller ID and matching the extra filters, walking every page.
+func (a *AwsCli) describeControllerInstances(ctx context.Context, extraFilters []types.Filter) ([]types.Instance, error) {
+	filters := []types.Filter{
+		{
+			Name:   aws.String("tag:" + util.ControllerIDTagName),
+			Values: []string{a.controllerID},
+		},
+		{
+			Name:   aws.String("instance-state-name"),
+			Values: activeInstanceStates,
 		},
+	}
+	filters = append(filters, extraFilters...)
+
+	paginator := ec2.NewDescribeInstancesPaginator(&a.client, &ec2.DescribeInstancesInput{
+		Filters: filters,
 	})
-	if err != nil {
-		return "", fmt.Errorf("failed to tag subnet: %w", err)
+
+	var instances []types.Instance
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list instances: %w", classifyError(err))
+		}
+		for _, reservation := range page.Reservations {
+			instances = append(instances, reservation.Instances...)
+		}
 	}
-	return *resp.Subnet.SubnetId, nil
+
+	return instances, nil
 }
 
 // TODO: Find a better way to implement this
-func (a *AwsCli) CreateRunningInstance(ctx context.Context, spec *spec.RunnerSpec, subnetID string) (string, error) {
+func (a *AwsCli) CreateRunningInstance(ctx context.Context, spec *spec.RunnerSpec) (*types.Instance, error) {
 
 	if spec == nil {
-		return "", fmt.Errorf("invalid nil runner spec")
+		return nil, fmt.Errorf("invalid nil runner spec")
 	}
 
-	resp, err := a.client.RunInstances(ctx, &ec2.RunInstancesInput{
-		ImageId:      aws.String(spec.BootstrapParams.Image),
-		InstanceType: types.InstanceType(spec.BootstrapParams.Flavor),
-		MaxCount:     aws.Int32(spec.MaxCount),
-		MinCount:     aws.Int32(spec.MinCount),
-		SubnetId:     aws.String(subnetID),
-		UserData:     aws.String(spec.UserData),
+	spec.LaunchGeneration = a.launchGeneration(spec.BootstrapParams.Name)
+	instance, err := a.runInstance(ctx, spec)
+	if err != nil && spec.SpotOptions != nil && spec.SpotOptions.FallbackToOnDemand && isAPIErrorCode(err, spotFallbackErrorCodes...) {
+		log.Printf("no spot capacity for %s (%s), falling back to on-demand", spec.BootstrapParams.Name, ErrorCode(err))
+		instance, err = a.runInstance(ctx, spec.OnDemand())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := a.checkReplayedLaunch(ctx, spec, instance); err != nil {
+		return nil, err
+	}
+	return instance, nil
+}
+
+// checkReplayedLaunch fails if EC2 answered the launch with an instance that
+// was terminated since. That happens when the launch generation of the
+// runner was lost, for example with the cache dir. The generation is
+// advanced, so the retry of the create launches a new instance.
+func (a *AwsCli) checkReplayedLaunch(ctx context.Context, spec *spec.RunnerSpec, instance *types.Instance) error {
+	current, err := a.GetInstance(ctx, aws.ToString(instance.InstanceId))
+	if err != nil {
+		if errors.Is(err, garmErrors.ErrNotFound) {
+			// New instances take a moment to show up.
+			return nil
+		}
+		return err
+	}
+	if current.State == nil {
+		return nil
+	}
+	switch current.State.Name {
+	case types.InstanceStateNameShuttingDown, types.InstanceStateNameTerminated:
+		a.advanceLaunchGeneration(spec.BootstrapParams.Name)
+		return fmt.Errorf("client token of %s was already used by instance %s, which is %s; retry to launch a new instance", spec.BootstrapParams.Name, aws.ToString(current.InstanceId), current.State.Name)
+	}
+	return nil
+}
+
+// runInstance launches a single instance described by the spec. Specs with
+// several candidate instance types are launched with an EC2 Fleet, which
+// spans all candidate subnets. Otherwise the candidate subnets are tried one
+// after the other.
+func (a *AwsCli) runInstance(ctx context.Context, spec *spec.RunnerSpec) (*types.Instance, error) {
+	if len(spec.InstanceTypes) > 0 {
+		return a.createFleetInstance(ctx, spec)
+	}
+	return a.runInstanceInSubnets(ctx, spec)
+}
+
+// ValidateArchitecture makes sure both the flavors and the image support the
+// requested OS architecture, so a mismatch fails with a clear error instead
+// of an opaque RunInstances failure.
+func (a *AwsCli) ValidateArchitecture(ctx context.Context, flavors []string, imageID string, osArch params.OSArch) error {
+	for _, flavor := range flavors {
+		instanceType, err := a.describeInstanceType(ctx, flavor)
+		if err != nil {
+			return err
+		}
+
+		var supported []string
+		flavorMatches := false
+		var processorArchs []types.ArchitectureType
+		if instanceType.ProcessorInfo != nil {
+			processorArchs = instanceType.ProcessorInfo.SupportedArchitectures
+		}
+		for _, arch := range processorArchs {
+			supported = append(supported, string(arch))
+			if convert.ArchitectureToOSArch(types.ArchitectureValues(arch)) == osArch {
+				flavorMatches = true
+			}
+		}
+		if !flavorMatches {
+			return garmErrors.NewBadRequestError("flavor %s does not support architecture %s (supported: %s)", flavor, osArch, strings.Join(supported, ", "))
+		}
+	}
+
+	image, err := a.describeImage(ctx, imageID)
+	if err != nil {
+		return err
+	}
+	if convert.ArchitectureToOSArch(image.Architecture) != osArch {
+		return garmErrors.NewBadRequestError("image %s has architecture %s, expected %s", imageID, image.Architecture, osArch)
+	}
+
+	return nil
+}
+
+func (a *AwsCli) describeImage(ctx context.Context, imageID string) (types.Image, error) {
+	resp, err := a.client.DescribeImages(ctx, &ec2.DescribeImagesInput{
+		ImageIds: []string{imageID},
 	})
 	if err != nil {
-		return "", fmt.Errorf("failed to create instance: %w", err)
+		return types.Image{}, fmt.Errorf("failed to describe image: %w", classifyError(err))
+	}
+	if len(resp.Images) == 0 {
+		return types.Image{}, garmErrors.NewBadRequestError("image %s not found", imageID)
 	}
+	return resp.Images[0], nil
+}
 
-	return *resp.Instances[0].InstanceId, nil
+func (a *AwsCli) describeInstanceType(ctx context.Context, flavor string) (types.InstanceTypeInfo, error) {
+	resp, err := a.client.DescribeInstanceTypes(ctx, &ec2.DescribeInstanceTypesInput{
+		InstanceTypes: []types.InstanceType{types.InstanceType(flavor)},
+	})
+	if err != nil {
+		return types.InstanceTypeInfo{}, fmt.Errorf("failed to describe instance type: %w", classifyError(err))
+	}
+	if len(resp.InstanceTypes) == 0 {
+		return types.InstanceTypeInfo{}, garmErrors.NewBadRequestError("instance type %s not found", flavor)
+	}
+	return resp.InstanceTypes[0], nil
 }
@@ -0,0 +1,85 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/aws/smithy-go"
+	"github.com/cloudbase/garm-provider-aws/internal/cache"
+)
+
+func TestLaunchGeneration(t *testing.T) {
+	cli := &AwsCli{
+		controllerID: "controller",
+		cache:        cache.New(t.TempDir()),
+	}
+
+	if generation := cli.launchGeneration("garm-runner"); generation != 0 {
+		t.Fatalf("expected generation 0 for a new runner, got %d", generation)
+	}
+	cli.advanceLaunchGeneration("garm-runner")
+	cli.advanceLaunchGeneration("garm-runner")
+	if generation := cli.launchGeneration("garm-runner"); generation != 2 {
+		t.Fatalf("expected generation 2, got %d", generation)
+	}
+	if generation := cli.launchGeneration("garm-other"); generation != 0 {
+		t.Fatalf("expected generations to be kept per runner, got %d", generation)
+	}
+}
+
+func TestMissingInstanceIDs(t *testing.T) {
+	ids := []string{"i-0123456789abcdef0", "i-0123456789abcdef1", "i-0123456789abcdef2"}
+	tests := []struct {
+		name string
+		err  error
+		want []string
+	}{
+		{
+			name: "single instance",
+			err:  &smithy.GenericAPIError{Code: "InvalidInstanceID.NotFound", Message: "The instance ID 'i-0123456789abcdef1' does not exist"},
+			want: []string{"i-0123456789abcdef1"},
+		},
+		{
+			name: "several instances",
+			err:  fmt.Errorf("wrapped: %w", &smithy.GenericAPIError{Code: "InvalidInstanceID.NotFound", Message: "The instance IDs 'i-0123456789abcdef0, i-0123456789abcdef2' do not exist"}),
+			want: []string{"i-0123456789abcdef0", "i-0123456789abcdef2"},
+		},
+		{
+			name: "instance not requested",
+			err:  &smithy.GenericAPIError{Code: "InvalidInstanceID.NotFound", Message: "The instance ID 'i-0123456789abcdef9' does not exist"},
+		},
+		{
+			name: "other error",
+			err:  &smithy.GenericAPIError{Code: "UnauthorizedOperation", Message: "i-0123456789abcdef1"},
+		},
+		{
+			name: "not an API error",
+			err:  errors.New("i-0123456789abcdef1"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := missingInstanceIDs(tt.err, ids)
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package client
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+// capacityFailureCodes are the launch errors that trip the capacity breaker
+// of an availability zone and instance type.
+var capacityFailureCodes = []string{
+	"InsufficientInstanceCapacity",
+}
+
+// capacityCacheName is the cache file holding the capacity failures of the
+// region. Each provider invocation is a separate process, so failures are
+// kept on disk to let later launches skip the availability zones and
+// instance types known to be out of capacity.
+func (a *AwsCli) capacityCacheName() string {
+	return fmt.Sprintf("capacity-%s", a.region)
+}
+
+// capacityKey identifies a capacity pool. Spot and on-demand capacity are
+// tracked separately, as running out of one says nothing about the other.
+func capacityKey(zone, instanceType, capacityType string) string {
+	return strings.Join([]string{zone, instanceType, capacityType}, "/")
+}
+
+// recordCapacityFailure trips the capacity breaker of the availability zone
+// and instance type for the configured cool-down.
+func (a *AwsCli) recordCapacityFailure(zone, instanceType, capacityType string) {
+	if zone == "" || instanceType == "" {
+		return
+	}
+	until := time.Now().Add(a.cfg.CapacityCooldown)
+	key := capacityKey(zone, instanceType, capacityType)
+	if err := a.cache.Store(a.capacityCacheName(), key, until, a.cfg.CapacityCooldown); err != nil {
+		log.Printf("failed to record capacity failure of %s: %s", key, err)
+	}
+}
+
+// capacityCooldown returns when the capacity breaker of the availability
+// zone and instance type resets, if it is tripped.
+func (a *AwsCli) capacityCooldown(zone, instanceType, capacityType string) (time.Time, bool) {
+	if zone == "" {
+		return time.Time{}, false
+	}
+	var until time.Time
+	key := capacityKey(zone, instanceType, capacityType)
+	found, err := a.cache.Load(a.capacityCacheName(), key, &until)
+	if err != nil {
+		log.Printf("failed to load capacity failure of %s: %s", key, err)
+		return time.Time{}, false
+	}
+	return until, found
+}
+
+// subnetsWithCapacity drops the subnets whose availability zone is cooling
+// down after running out of capacity for the instance type.
+func (a *AwsCli) subnetsWithCapacity(subnets []candidateSubnet, instanceType, capacityType string) []candidateSubnet {
+	var available []candidateSubnet
+	for _, subnet := range subnets {
+		if until, ok := a.capacityCooldown(subnet.AvailabilityZone, instanceType, capacityType); ok {
+			log.Printf("skipping %s: no %s %s capacity until %s", subnet.AvailabilityZone, capacityType, instanceType, until.Format(time.RFC3339))
+			continue
+		}
+		available = append(available, subnet)
+	}
+	return available
+}
+
+// capacityCooldownError is returned when every candidate is cooling down. It
+// carries the same code as the failures that tripped the breakers, so it is
+// handled like them, for example by falling back to on-demand capacity.
+func capacityCooldownError(instanceTypes []string, capacityType string) error {
+	return classifyError(&smithy.GenericAPIError{
+		Code:    "InsufficientInstanceCapacity",
+		Message: fmt.Sprintf("no %s capacity for %s in any candidate availability zone until the cool-down expires", capacityType, strings.Join(instanceTypes, ", ")),
+	})
+}
@@ -0,0 +1,123 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package client
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/cloudbase/garm-provider-aws/config"
+	"github.com/cloudbase/garm-provider-aws/internal/cache"
+	"github.com/cloudbase/garm-provider-aws/internal/spec"
+	awsUtil "github.com/cloudbase/garm-provider-aws/internal/util"
+)
+
+func testCapacityCli(t *testing.T, cooldown time.Duration) *AwsCli {
+	return &AwsCli{
+		cfg:    &config.Config{CapacityCooldown: cooldown},
+		region: "eu-central-1",
+		cache:  cache.New(t.TempDir()),
+	}
+}
+
+func TestCapacityBreaker(t *testing.T) {
+	cli := testCapacityCli(t, time.Hour)
+	subnets := []candidateSubnet{
+		{ID: "subnet-a", AvailabilityZone: "eu-central-1a"},
+		{ID: "subnet-b", AvailabilityZone: "eu-central-1b"},
+	}
+
+	cli.recordCapacityFailure("eu-central-1a", "m7i.large", awsUtil.CapacityTypeSpot)
+
+	until, ok := cli.capacityCooldown("eu-central-1a", "m7i.large", awsUtil.CapacityTypeSpot)
+	if !ok || time.Until(until) <= 0 {
+		t.Fatalf("expected breaker to be tripped, got %v %v", until, ok)
+	}
+	if got := subnetIDs(cli.subnetsWithCapacity(subnets, "m7i.large", awsUtil.CapacityTypeSpot)); !reflect.DeepEqual(got, []string{"subnet-b"}) {
+		t.Fatalf("expected subnet-b only, got %v", got)
+	}
+	if got := subnetIDs(cli.subnetsWithCapacity(subnets, "m7i.large", awsUtil.CapacityTypeOnDemand)); len(got) != 2 {
+		t.Fatalf("expected on-demand capacity to be unaffected, got %v", got)
+	}
+	if got := subnetIDs(cli.subnetsWithCapacity(subnets, "m6i.large", awsUtil.CapacityTypeSpot)); len(got) != 2 {
+		t.Fatalf("expected other instance types to be unaffected, got %v", got)
+	}
+
+	cli.recordCapacityFailure("eu-central-1b", "m7i.large", awsUtil.CapacityTypeSpot)
+	if got := cli.subnetsWithCapacity(subnets, "m7i.large", awsUtil.CapacityTypeSpot); len(got) != 0 {
+		t.Fatalf("expected every subnet to be skipped, got %v", subnetIDs(got))
+	}
+	if err := capacityCooldownError([]string{"m7i.large"}, awsUtil.CapacityTypeSpot); !isAPIErrorCode(err, spotFallbackErrorCodes...) {
+		t.Fatalf("expected cool-down error to allow spot fallback, got %v", err)
+	}
+}
+
+func TestCapacityBreakerExpires(t *testing.T) {
+	cli := testCapacityCli(t, time.Millisecond)
+
+	cli.recordCapacityFailure("eu-central-1a", "m7i.large", awsUtil.CapacityTypeOnDemand)
+	time.Sleep(10 * time.Millisecond)
+	if _, ok := cli.capacityCooldown("eu-central-1a", "m7i.large", awsUtil.CapacityTypeOnDemand); ok {
+		t.Fatalf("expected breaker to reset after the cool-down")
+	}
+}
+
+func TestRecordFleetCapacityFailures(t *testing.T) {
+	cli := testCapacityCli(t, time.Hour)
+
+	cli.recordFleetCapacityFailures([]types.CreateFleetError{
+		{
+			ErrorCode: aws.String("InsufficientInstanceCapacity"),
+			LaunchTemplateAndOverrides: &types.LaunchTemplateAndOverridesResponse{
+				Overrides: &types.FleetLaunchTemplateOverrides{
+					InstanceType: "m7i.large",
+					SubnetId:     aws.String("subnet-a"),
+				},
+			},
+		},
+		{
+			ErrorCode: aws.String("UnfulfillableCapacity"),
+			LaunchTemplateAndOverrides: &types.LaunchTemplateAndOverridesResponse{
+				Overrides: &types.FleetLaunchTemplateOverrides{
+					InstanceType: "m6i.large",
+					SubnetId:     aws.String("subnet-a"),
+				},
+			},
+		},
+	}, map[string]string{"subnet-a": "eu-central-1a"}, awsUtil.CapacityTypeSpot)
+
+	if _, ok := cli.capacityCooldown("eu-central-1a", "m7i.large", awsUtil.CapacityTypeSpot); !ok {
+		t.Fatalf("expected capacity failure to be recorded")
+	}
+	if _, ok := cli.capacityCooldown("eu-central-1a", "m6i.large", awsUtil.CapacityTypeSpot); ok {
+		t.Fatalf("expected other errors to be ignored")
+	}
+
+	runnerSpec := &spec.RunnerSpec{
+		InstanceTypes: []spec.InstanceType{{InstanceType: "m7i.large"}, {InstanceType: "m6i.large"}},
+		SpotOptions:   &spec.SpotOptions{},
+	}
+	input := fleetInput(runnerSpec, "lt-0123456789abcdef0", []string{"subnet-a"}, func(instanceType, subnetID string) bool {
+		_, ok := cli.capacityCooldown(map[string]string{"subnet-a": "eu-central-1a"}[subnetID], instanceType, awsUtil.CapacityTypeSpot)
+		return ok
+	})
+	overrides := input.LaunchTemplateConfigs[0].Overrides
+	if len(overrides) != 1 || overrides[0].InstanceType != "m6i.large" {
+		t.Fatalf("expected only the m6i.large override, got %+v", overrides)
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package client
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/aws/smithy-go"
+	garmErrors "github.com/cloudbase/garm-provider-common/errors"
+)
+
+// errorClass describes how an EC2 API error code maps onto GARM errors.
+type errorClass struct {
+	// kind is the garm-provider-common error the API error is wrapped into.
+	kind func(apiErr smithy.APIError) error
+	// retryable is true if the same request may succeed later.
+	retryable bool
+}
+
+var (
+	notFound = func(apiErr smithy.APIError) error {
+		return garmErrors.ErrNotFound
+	}
+	badRequest = func(apiErr smithy.APIError) error {
+		return garmErrors.ErrBadRequest
+	}
+	unauthorized = func(apiErr smithy.APIError) error {
+		return garmErrors.ErrUnauthorized
+	}
+	conflict = func(apiErr smithy.APIError) error {
+		return garmErrors.NewConflictError("%s", apiErr.ErrorCode())
+	}
+	providerFault = func(apiErr smithy.APIError) error {
+		return garmErrors.NewProviderError("%s", apiErr.ErrorCode())
+	}
+)
+
+// errorClasses maps EC2 API error codes to their classification. Codes not
+// listed here are returned as is.
+var errorClasses = map[string]errorClass{
+	// Resources that do not exist.
+	"InvalidInstanceID.NotFound":         {kind: notFound},
+	"InvalidVpcID.NotFound":              {kind: notFound},
+	"InvalidSubnetID.NotFound":           {kind: notFound},
+	"InvalidInternetGatewayID.NotFound":  {kind: notFound},
+	"InvalidRouteTableID.NotFound":       {kind: notFound},
+	"InvalidGroup.NotFound":              {kind: notFound},
+	"InvalidVolume.NotFound":             {kind: notFound},
+	"InvalidNetworkInterfaceID.NotFound": {kind: notFound},
+
+	// Malformed or invalid requests. Retrying will not help.
+	"InvalidParameterValue":       {kind: badRequest},
+	"InvalidParameterCombination": {kind: badRequest},
+	"InvalidParameter":            {kind: badRequest},
+	"MissingParameter":            {kind: badRequest},
+	"InvalidInstanceID.Malformed": {kind: badRequest},
+	"InvalidAMIID.NotFound":       {kind: badRequest},
+	"InvalidAMIID.Malformed":      {kind: badRequest},
+	"InvalidAMIID.Unavailable":    {kind: badRequest},
+	"InvalidKeyPair.NotFound":     {kind: badRequest},
+	"InvalidSnapshot.NotFound":    {kind: badRequest},
+	"InvalidBlockDeviceMapping":   {kind: badRequest},
+	"Unsupported":                 {kind: badRequest},
+	"UnsupportedOperation":        {kind: badRequest},
+	"VPCIdNotSpecified":           {kind: badRequest},
+	"InvalidCIDRBlock":            {kind: badRequest},
+	"SpotMaxPriceTooLow":          {kind: badRequest},
+
+	// Credentials or permissions problems.
+	"UnauthorizedOperation": {kind: unauthorized},
+	"AuthFailure":           {kind: unauthorized},
+	"InvalidClientTokenId":  {kind: unauthorized},
+	"SignatureDoesNotMatch": {kind: unauthorized},
+	"ExpiredToken":          {kind: unauthorized},
+	"RequestExpired":        {kind: unauthorized},
+	"OptInRequired":         {kind: unauthorized},
+	"Blocked":               {kind: unauthorized},
+
+	// The resource is in a state that does not allow the operation. These
+	// usually resolve themselves.
+	"IncorrectInstanceState":      {kind: conflict, retryable: true},
+	"IncorrectState":              {kind: conflict, retryable: true},
+	"DependencyViolation":         {kind: conflict, retryable: true},
+	"IdempotentParameterMismatch": {kind: conflict},
+	"Resource.AlreadyAssociated":  {kind: conflict},
+	"RouteAlreadyExists":          {kind: conflict},
+	"InvalidSubnet.Conflict":      {kind: conflict},
+
+	// Capacity, quota and throttling.
+	"InsufficientInstanceCapacity":         {kind: providerFault, retryable: true},
+	"InsufficientHostCapacity":             {kind: providerFault, retryable: true},
+	"InsufficientReservedInstanceCapacity": {kind: providerFault, retryable: true},
+	"InsufficientCapacity":                 {kind: providerFault, retryable: true},
+	"InsufficientFreeAddressesInSubnet":    {kind: providerFault, retryable: true},
+	"RequestLimitExceeded":                 {kind: providerFault, retryable: true},
+	"Throttling":                           {kind: providerFault, retryable: true},
+	"ThrottlingException":                  {kind: providerFault, retryable: true},
+	"InternalError":                        {kind: providerFault, retryable: true},
+	"InternalFailure":                      {kind: providerFault, retryable: true},
+	"ServiceUnavailable":                   {kind: providerFault, retryable: true},
+	"Unavailable":                          {kind: providerFault, retryable: true},
+	"InstanceLimitExceeded":                {kind: providerFault},
+	"VcpuLimitExceeded":                    {kind: providerFault},
+	"MaxSpotInstanceCountExceeded":         {kind: providerFault},
+	"VpcLimitExceeded":                     {kind: providerFault},
+	"InternetGatewayLimitExceeded":         {kind: providerFault},
+}
+
+// classifiedError wraps an EC2 API error into a garm-provider-common error
+// type, while keeping the original error reachable through errors.As.
+type classifiedError struct {
+	err       error
+	kind      error
+	retryable bool
+}
+
+func (c *classifiedError) Error() string {
+	return c.err.Error()
+}
+
+func (c *classifiedError) Unwrap() []error {
+	return []error{c.kind, c.err}
+}
+
+// classifyError wraps EC2 API errors into the matching garm-provider-common
+// error type. Errors that are not API errors, or that have an unknown code,
+// are returned unchanged.
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var classified *classifiedError
+	if errors.As(err, &classified) {
+		return err
+	}
+
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+
+	class, ok := errorClasses[apiErr.ErrorCode()]
+	if !ok {
+		return err
+	}
+
+	return &classifiedError{
+		err:       err,
+		kind:      class.kind(apiErr),
+		retryable: class.retryable,
+	}
+}
+
+// isRetryable returns true if err was caused by an EC2 API error that may
+// succeed if the request is retried later.
+func isRetryable(err error) bool {
+	var classified *classifiedError
+	if errors.As(err, &classified) {
+		return classified.retryable
+	}
+	return false
+}
+
+// ErrorCode returns the EC2 API error code wrapped by err, if any.
+func ErrorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	return ""
+}
+
+// isAPIErrorCode returns true if any EC2 API error wrapped by err, including
+// the ones combined with errors.Join, has one of the codes.
+func isAPIErrorCode(err error, codes ...string) bool {
+	for _, code := range apiErrorCodes(err) {
+		if slices.Contains(codes, code) {
+			return true
+		}
+	}
+	return false
+}
+
+// apiErrorCodes returns the codes of all EC2 API errors wrapped by err.
+// Unlike errors.As, it does not stop at the first one.
+func apiErrorCodes(err error) []string {
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case smithy.APIError:
+		return []string{e.ErrorCode()}
+	case interface{ Unwrap() []error }:
+		var codes []string
+		for _, wrapped := range e.Unwrap() {
+			codes = append(codes, apiErrorCodes(wrapped)...)
+		}
+		return codes
+	case interface{ Unwrap() error }:
+		return apiErrorCodes(e.Unwrap())
+	}
+	return nil
+}
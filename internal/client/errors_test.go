@@ -0,0 +1,115 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/smithy-go"
+	garmErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-common/execution"
+)
+
+func TestClassifyError(t *testing.T) {
+	var (
+		conflictErr *garmErrors.ConflictError
+		providerErr *garmErrors.ProviderError
+	)
+	isConflict := func(err error) bool { return errors.As(err, &conflictErr) }
+	isProvider := func(err error) bool { return errors.As(err, &providerErr) }
+	is := func(target error) func(error) bool {
+		return func(err error) bool { return errors.Is(err, target) }
+	}
+
+	tests := []struct {
+		code      string
+		matches   func(error) bool
+		retryable bool
+		exitCode  int
+	}{
+		{"InvalidInstanceID.NotFound", is(garmErrors.ErrNotFound), false, execution.ExitCodeNotFound},
+		{"InvalidVpcID.NotFound", is(garmErrors.ErrNotFound), false, execution.ExitCodeNotFound},
+		{"InvalidSubnetID.NotFound", is(garmErrors.ErrNotFound), false, execution.ExitCodeNotFound},
+		{"InvalidGroup.NotFound", is(garmErrors.ErrNotFound), false, execution.ExitCodeNotFound},
+		{"InvalidParameterValue", is(garmErrors.ErrBadRequest), false, 1},
+		{"InvalidParameterCombination", is(garmErrors.ErrBadRequest), false, 1},
+		{"MissingParameter", is(garmErrors.ErrBadRequest), false, 1},
+		{"InvalidInstanceID.Malformed", is(garmErrors.ErrBadRequest), false, 1},
+		{"InvalidAMIID.NotFound", is(garmErrors.ErrBadRequest), false, 1},
+		{"InvalidKeyPair.NotFound", is(garmErrors.ErrBadRequest), false, 1},
+		{"UnauthorizedOperation", is(garmErrors.ErrUnauthorized), false, 1},
+		{"AuthFailure", is(garmErrors.ErrUnauthorized), false, 1},
+		{"ExpiredToken", is(garmErrors.ErrUnauthorized), false, 1},
+		{"OptInRequired", is(garmErrors.ErrUnauthorized), false, 1},
+		{"IncorrectInstanceState", isConflict, true, 1},
+		{"DependencyViolation", isConflict, true, 1},
+		{"IdempotentParameterMismatch", isConflict, false, 1},
+		{"InsufficientInstanceCapacity", isProvider, true, 1},
+		{"RequestLimitExceeded", isProvider, true, 1},
+		{"InternalError", isProvider, true, 1},
+		{"Unavailable", isProvider, true, 1},
+		{"InstanceLimitExceeded", isProvider, false, 1},
+		{"VcpuLimitExceeded", isProvider, false, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			apiErr := &smithy.GenericAPIError{Code: tt.code, Message: "test message"}
+			err := fmt.Errorf("failed to do something: %w", classifyError(apiErr))
+
+			if !tt.matches(err) {
+				t.Fatalf("error %v was not classified as expected", err)
+			}
+			if isRetryable(err) != tt.retryable {
+				t.Fatalf("expected retryable %v, got %v", tt.retryable, isRetryable(err))
+			}
+			if code := execution.ResolveErrorToExitCode(err); code != tt.exitCode {
+				t.Fatalf("expected exit code %d, got %d", tt.exitCode, code)
+			}
+			if code := ErrorCode(err); code != tt.code {
+				t.Fatalf("expected error code %q, got %q", tt.code, code)
+			}
+			if err.Error() != "failed to do something: "+apiErr.Error() {
+				t.Fatalf("unexpected error message: %q", err.Error())
+			}
+		})
+	}
+}
+
+func TestClassifyErrorPassthrough(t *testing.T) {
+	if classifyError(nil) != nil {
+		t.Fatalf("expected nil error")
+	}
+
+	plain := fmt.Errorf("plain error")
+	if err := classifyError(plain); err != plain {
+		t.Fatalf("expected plain error to be returned unchanged, got %v", err)
+	}
+
+	unknown := &smithy.GenericAPIError{Code: "SomethingNew"}
+	if err := classifyError(unknown); err != unknown {
+		t.Fatalf("expected unknown API error to be returned unchanged, got %v", err)
+	}
+	if isRetryable(unknown) {
+		t.Fatalf("expected unknown API error not to be retryable")
+	}
+
+	classified := classifyError(&smithy.GenericAPIError{Code: "InvalidInstanceID.NotFound"})
+	if err := classifyError(classified); err != classified {
+		t.Fatalf("expected classified error not to be wrapped twice")
+	}
+}
@@ -0,0 +1,380 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+	"github.com/cloudbase/garm-provider-aws/internal/spec"
+	awsUtil "github.com/cloudbase/garm-provider-aws/internal/util"
+	garmErrors "github.com/cloudbase/garm-provider-common/errors"
+)
+
+const (
+	// maxFleetOverrides is the maximum number of launch template overrides
+	// accepted by a single CreateFleet call.
+	maxFleetOverrides = 300
+	// fleetInstanceTimeout is how long we wait for an instance launched by a
+	// fleet to become visible to DescribeInstances.
+	fleetInstanceTimeout = 2 * time.Minute
+)
+
+// createFleetInstance launches a single runner with an EC2 Fleet in instant
+// mode, letting the fleet pick among the candidate instance types and
+// subnets of the spec. The launch template the fleet needs is created from
+// the same request RunInstances would get and deleted once the fleet returns.
+func (a *AwsCli) createFleetInstance(ctx context.Context, spec *spec.RunnerSpec) (*types.Instance, error) {
+	if spec.Hibernate {
+		return nil, garmErrors.NewBadRequestError("hibernation is not supported with instance_types")
+	}
+
+	subnets := spec.CandidateSubnets()
+	if len(subnets) == 0 {
+		return nil, fmt.Errorf("no subnet configured for runner")
+	}
+	if spec.InstanceRequirements != nil {
+		// Instance types resolved from requirements are sorted newest
+		// generation first. Keep as many as the fleet accepts.
+		if limit := maxFleetOverrides / len(subnets); len(spec.InstanceTypes) > limit {
+			trimmed := *spec
+			trimmed.InstanceTypes = spec.InstanceTypes[:limit]
+			spec = &trimmed
+		}
+	}
+	if count := len(subnets) * len(spec.InstanceTypes); count > maxFleetOverrides {
+		return nil, garmErrors.NewBadRequestError("%d instance types in %d subnets exceed the limit of %d fleet overrides", len(spec.InstanceTypes), len(subnets), maxFleetOverrides)
+	}
+
+	runInput, err := a.runInstancesInput(ctx, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	templateID, err := a.createLaunchTemplate(ctx, spec, runInput)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := a.deleteLaunchTemplate(context.WithoutCancel(ctx), templateID); err != nil {
+			log.Printf("failed to delete launch template %s: %s", templateID, err)
+		}
+	}()
+
+	zones, err := a.subnetAvailabilityZones(ctx, subnets)
+	if err != nil {
+		return nil, err
+	}
+	capacityType := spec.CapacityType()
+	input := fleetInput(spec, templateID, subnets, func(instanceType, subnetID string) bool {
+		_, ok := a.capacityCooldown(zones[subnetID], instanceType, capacityType)
+		return ok
+	})
+	if len(input.LaunchTemplateConfigs[0].Overrides) == 0 {
+		return nil, fmt.Errorf("failed to create instance: %w", capacityCooldownError(spec.Flavors(), capacityType))
+	}
+	resp, err := a.client.CreateFleet(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create fleet: %w", classifyError(err))
+	}
+	a.recordFleetCapacityFailures(resp.Errors, zones, capacityType)
+
+	var instanceIDs []string
+	for _, instance := range resp.Instances {
+		instanceIDs = append(instanceIDs, instance.InstanceIds...)
+	}
+	if len(instanceIDs) == 0 {
+		// Instant fleets keep their result under the client token, so a
+		// retry with the same token would fail the same way. Nothing was
+		// launched, so the runner can safely get a new token.
+		a.advanceLaunchGeneration(spec.BootstrapParams.Name)
+		return nil, fmt.Errorf("failed to create instance: %w", fleetError(resp.Errors))
+	}
+	if len(instanceIDs) > 1 {
+		// Weights are at least 1, so a single instance always fulfills
+		// the target capacity. Don't leak anything the fleet launched in
+		// excess.
+		log.Printf("fleet launched %d instances for %s, terminating extra instances", len(instanceIDs), spec.BootstrapParams.Name)
+		if err := a.TerminateInstances(ctx, instanceIDs[1:]); err != nil {
+			return nil, fmt.Errorf("failed to terminate extra fleet instances: %w", err)
+		}
+	}
+
+	err = ec2.NewInstanceExistsWaiter(&a.client).Wait(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: instanceIDs[:1],
+	}, fleetInstanceTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed waiting for instance %s: %w", instanceIDs[0], classifyError(err))
+	}
+	return a.GetInstance(ctx, instanceIDs[0])
+}
+
+// fleetInput builds the CreateFleet request. Each candidate instance type is
+// offered in every candidate subnet, unless skip reports the combination
+// as out of capacity.
+func fleetInput(spec *spec.RunnerSpec, templateID string, subnets []string, skip func(instanceType, subnetID string) bool) *ec2.CreateFleetInput {
+	var overrides []types.FleetLaunchTemplateOverridesRequest
+	for _, instanceType := range spec.InstanceTypes {
+		for _, subnetID := range subnets {
+			if skip != nil && skip(instanceType.InstanceType, subnetID) {
+				continue
+			}
+			override := types.FleetLaunchTemplateOverridesRequest{
+				InstanceType: types.InstanceType(instanceType.InstanceType),
+				SubnetId:     aws.String(subnetID),
+			}
+			if instanceType.Weight > 0 {
+				override.WeightedCapacity = aws.Float64(instanceType.Weight)
+			}
+			if spec.SpotOptions != nil && spec.SpotOptions.MaxPrice != "" {
+				override.MaxPrice = aws.String(spec.SpotOptions.MaxPrice)
+			}
+			overrides = append(overrides, override)
+		}
+	}
+
+	input := &ec2.CreateFleetInput{
+		Type:        types.FleetTypeInstant,
+		ClientToken: aws.String(fleetClientToken(spec.ClientToken(), spec.InstanceTypes, subnets)),
+		LaunchTemplateConfigs: []types.FleetLaunchTemplateConfigRequest{
+			{
+				LaunchTemplateSpecification: &types.FleetLaunchTemplateSpecificationRequest{
+					LaunchTemplateId: aws.String(templateID),
+					Version:          aws.String("$Latest"),
+				},
+				Overrides: overrides,
+			},
+		},
+		TargetCapacitySpecification: &types.TargetCapacitySpecificationRequest{
+			TotalTargetCapacity: aws.Int32(1),
+		},
+	}
+
+	if spec.SpotOptions != nil {
+		strategy := types.SpotAllocationStrategyPriceCapacityOptimized
+		if spec.AllocationStrategy != "" {
+			strategy = types.SpotAllocationStrategy(spec.AllocationStrategy)
+		}
+		input.TargetCapacitySpecification.DefaultTargetCapacityType = types.DefaultTargetCapacityTypeSpot
+		input.SpotOptions = &types.SpotOptionsRequest{
+			AllocationStrategy:           strategy,
+			InstanceInterruptionBehavior: types.SpotInstanceInterruptionBehaviorTerminate,
+		}
+	} else {
+		// On-demand capacity only supports lowest-price. Pools can only
+		// pick another strategy for spot, which does not apply when they
+		// fall back to on-demand.
+		input.TargetCapacitySpecification.DefaultTargetCapacityType = types.DefaultTargetCapacityTypeOnDemand
+		input.OnDemandOptions = &types.OnDemandOptionsRequest{
+			AllocationStrategy: types.FleetOnDemandAllocationStrategyLowestPrice,
+		}
+	}
+
+	// With a target capacity of one instance, the total price is the price
+	// of the runner.
+	if requirements := spec.InstanceRequirements; requirements != nil && requirements.MaxPrice != "" {
+		if input.SpotOptions != nil {
+			input.SpotOptions.MaxTotalPrice = aws.String(requirements.MaxPrice)
+		} else {
+			input.OnDemandOptions.MaxTotalPrice = aws.String(requirements.MaxPrice)
+		}
+	}
+	return input
+}
+
+// fleetClientToken derives the client token of a fleet launch from the
+// client token of the runner and all candidate instance types and subnets.
+// The overrides skipped for capacity cool-downs are left out on purpose, as
+// they may change between retries of a create. A retry then either replays
+// the launch or is rejected as mismatching, but never launches another
+// instance.
+func fleetClientToken(token string, instanceTypes []spec.InstanceType, subnets []string) string {
+	parts := []string{token}
+	for _, instanceType := range instanceTypes {
+		for _, subnetID := range subnets {
+			parts = append(parts, fmt.Sprintf("%s@%s", instanceType.InstanceType, subnetID))
+		}
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, "/")))
+	return hex.EncodeToString(sum[:])
+}
+
+// fleetError combines the errors reported by an instant fleet that did not
+// launch anything. Each error keeps its EC2 error code, so capacity errors
+// can be told apart.
+func fleetError(fleetErrors []types.CreateFleetError) error {
+	if len(fleetErrors) == 0 {
+		return fmt.Errorf("fleet did not launch any instance")
+	}
+
+	var errs []error
+	seen := map[string]bool{}
+	for _, fleetErr := range fleetErrors {
+		code := aws.ToString(fleetErr.ErrorCode)
+		if seen[code] {
+			continue
+		}
+		seen[code] = true
+		errs = append(errs, classifyError(&smithy.GenericAPIError{
+			Code:    code,
+			Message: aws.ToString(fleetErr.ErrorMessage),
+		}))
+	}
+	return errors.Join(errs...)
+}
+
+// recordFleetCapacityFailures trips the capacity breakers of the overrides
+// a fleet could not launch for lack of capacity.
+func (a *AwsCli) recordFleetCapacityFailures(fleetErrors []types.CreateFleetError, zones map[string]string, capacityType string) {
+	for _, fleetErr := range fleetErrors {
+		if !slices.Contains(capacityFailureCodes, aws.ToString(fleetErr.ErrorCode)) {
+			continue
+		}
+		if fleetErr.LaunchTemplateAndOverrides == nil || fleetErr.LaunchTemplateAndOverrides.Overrides == nil {
+			continue
+		}
+		overrides := fleetErr.LaunchTemplateAndOverrides.Overrides
+		zone := aws.ToString(overrides.AvailabilityZone)
+		if zone == "" {
+			zone = zones[aws.ToString(overrides.SubnetId)]
+		}
+		a.recordCapacityFailure(zone, string(overrides.InstanceType), capacityType)
+	}
+}
+
+// createLaunchTemplate creates the launch template of a fleet launch. The
+// template is named after the client token of the runner, so a template left
+// behind by an interrupted launch is replaced.
+func (a *AwsCli) createLaunchTemplate(ctx context.Context, spec *spec.RunnerSpec, input *ec2.RunInstancesInput) (string, error) {
+	templateInput := &ec2.CreateLaunchTemplateInput{
+		LaunchTemplateName: aws.String(fmt.Sprintf("garm-%s", spec.ClientToken())),
+		LaunchTemplateData: launchTemplateData(input),
+		TagSpecifications: []types.TagSpecification{
+			{
+				ResourceType: types.ResourceTypeLaunchTemplate,
+				Tags: []types.Tag{
+					{
+						Key:   aws.String(awsUtil.ControllerIDTagName),
+						Value: aws.String(a.controllerID),
+					},
+				},
+			},
+		},
+	}
+
+	resp, err := a.client.CreateLaunchTemplate(ctx, templateInput)
+	if err != nil && isAPIErrorCode(err, "InvalidLaunchTemplateName.AlreadyExistsException") {
+		_, delErr := a.client.DeleteLaunchTemplate(ctx, &ec2.DeleteLaunchTemplateInput{
+			LaunchTemplateName: templateInput.LaunchTemplateName,
+		})
+		if delErr != nil {
+			return "", fmt.Errorf("failed to delete stale launch template: %w", classifyError(delErr))
+		}
+		resp, err = a.client.CreateLaunchTemplate(ctx, templateInput)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to create launch template: %w", classifyError(err))
+	}
+	return aws.ToString(resp.LaunchTemplate.LaunchTemplateId), nil
+}
+
+func (a *AwsCli) deleteLaunchTemplate(ctx context.Context, templateID string) error {
+	_, err := a.client.DeleteLaunchTemplate(ctx, &ec2.DeleteLaunchTemplateInput{
+		LaunchTemplateId: aws.String(templateID),
+	})
+	if err != nil && !isAPIErrorCode(err, "InvalidLaunchTemplateId.NotFound") {
+		return classifyError(err)
+	}
+	return nil
+}
+
+// launchTemplateData converts a RunInstances request into launch template
+// data. The instance type and subnet are set by the fleet overrides and spot
+// options by the fleet itself, so they are left out.
+func launchTemplateData(input *ec2.RunInstancesInput) *types.RequestLaunchTemplateData {
+	data := &types.RequestLaunchTemplateData{
+		ImageId:          input.ImageId,
+		UserData:         input.UserData,
+		SecurityGroupIds: input.SecurityGroupIds,
+		KeyName:          input.KeyName,
+	}
+
+	if profile := input.IamInstanceProfile; profile != nil {
+		data.IamInstanceProfile = &types.LaunchTemplateIamInstanceProfileSpecificationRequest{
+			Arn:  profile.Arn,
+			Name: profile.Name,
+		}
+	}
+	if placement := input.Placement; placement != nil {
+		data.Placement = &types.LaunchTemplatePlacementRequest{
+			AvailabilityZone: placement.AvailabilityZone,
+			GroupName:        placement.GroupName,
+			HostId:           placement.HostId,
+			Tenancy:          placement.Tenancy,
+		}
+	}
+	data.CreditSpecification = input.CreditSpecification
+	if opts := input.MetadataOptions; opts != nil {
+		data.MetadataOptions = &types.LaunchTemplateInstanceMetadataOptionsRequest{
+			HttpTokens:              types.LaunchTemplateHttpTokensState(opts.HttpTokens),
+			HttpPutResponseHopLimit: opts.HttpPutResponseHopLimit,
+			HttpEndpoint:            types.LaunchTemplateInstanceMetadataEndpointState(opts.HttpEndpoint),
+			InstanceMetadataTags:    types.LaunchTemplateInstanceMetadataTagsState(opts.InstanceMetadataTags),
+		}
+	}
+	if opts := input.HibernationOptions; opts != nil {
+		data.HibernationOptions = &types.LaunchTemplateHibernationOptionsRequest{
+			Configured: opts.Configured,
+		}
+	}
+
+	for _, mapping := range input.BlockDeviceMappings {
+		templateMapping := types.LaunchTemplateBlockDeviceMappingRequest{
+			DeviceName: mapping.DeviceName,
+		}
+		if ebs := mapping.Ebs; ebs != nil {
+			templateMapping.Ebs = &types.LaunchTemplateEbsBlockDeviceRequest{
+				DeleteOnTermination: ebs.DeleteOnTermination,
+				Encrypted:           ebs.Encrypted,
+				Iops:                ebs.Iops,
+				KmsKeyId:            ebs.KmsKeyId,
+				SnapshotId:          ebs.SnapshotId,
+				Throughput:          ebs.Throughput,
+				VolumeSize:          ebs.VolumeSize,
+				VolumeType:          ebs.VolumeType,
+			}
+		}
+		data.BlockDeviceMappings = append(data.BlockDeviceMappings, templateMapping)
+	}
+
+	for _, tagSpec := range input.TagSpecifications {
+		data.TagSpecifications = append(data.TagSpecifications, types.LaunchTemplateTagSpecificationRequest{
+			ResourceType: tagSpec.ResourceType,
+			Tags:         tagSpec.Tags,
+		})
+	}
+	return data
+}
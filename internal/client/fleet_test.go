@@ -0,0 +1,223 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package client
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/cloudbase/garm-provider-aws/internal/spec"
+)
+
+func TestFleetInput(t *testing.T) {
+	instanceTypes := []spec.InstanceType{
+		{InstanceType: "m7i.large", Weight: 2},
+		{InstanceType: "m6i.large"},
+	}
+	subnets := []string{"subnet-0123456789abcdef0", "subnet-0fedcba9876543210"}
+
+	tests := []struct {
+		name               string
+		spotOptions        *spec.SpotOptions
+		allocationStrategy string
+		capacityType       types.DefaultTargetCapacityType
+		spotStrategy       types.SpotAllocationStrategy
+		onDemandStrategy   types.FleetOnDemandAllocationStrategy
+	}{
+		{
+			name:             "on-demand default",
+			capacityType:     types.DefaultTargetCapacityTypeOnDemand,
+			onDemandStrategy: types.FleetOnDemandAllocationStrategyLowestPrice,
+		},
+		{
+			name:               "on-demand lowest price",
+			allocationStrategy: "lowest-price",
+			capacityType:       types.DefaultTargetCapacityTypeOnDemand,
+			onDemandStrategy:   types.FleetOnDemandAllocationStrategyLowestPrice,
+		},
+		{
+			name:         "spot default",
+			spotOptions:  &spec.SpotOptions{MaxPrice: "0.05"},
+			capacityType: types.DefaultTargetCapacityTypeSpot,
+			spotStrategy: types.SpotAllocationStrategyPriceCapacityOptimized,
+		},
+		{
+			name:               "spot lowest price",
+			spotOptions:        &spec.SpotOptions{},
+			allocationStrategy: "lowest-price",
+			capacityType:       types.DefaultTargetCapacityTypeSpot,
+			spotStrategy:       types.SpotAllocationStrategyLowestPrice,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runnerSpec := &spec.RunnerSpec{
+				InstanceTypes:      instanceTypes,
+				AllocationStrategy: tt.allocationStrategy,
+				SpotOptions:        tt.spotOptions,
+			}
+			input := fleetInput(runnerSpec, "lt-0123456789abcdef0", subnets, nil)
+
+			if input.Type != types.FleetTypeInstant {
+				t.Fatalf("expected instant fleet, got %s", input.Type)
+			}
+			capacity := input.TargetCapacitySpecification
+			if aws.ToInt32(capacity.TotalTargetCapacity) != 1 || capacity.DefaultTargetCapacityType != tt.capacityType {
+				t.Fatalf("unexpected target capacity %d %s", aws.ToInt32(capacity.TotalTargetCapacity), capacity.DefaultTargetCapacityType)
+			}
+			if tt.spotOptions != nil {
+				if input.SpotOptions == nil || input.SpotOptions.AllocationStrategy != tt.spotStrategy {
+					t.Fatalf("expected spot strategy %s, got %+v", tt.spotStrategy, input.SpotOptions)
+				}
+				if input.OnDemandOptions != nil {
+					t.Fatalf("unexpected on-demand options")
+				}
+			} else {
+				if input.OnDemandOptions == nil || input.OnDemandOptions.AllocationStrategy != tt.onDemandStrategy {
+					t.Fatalf("expected on-demand strategy %s, got %+v", tt.onDemandStrategy, input.OnDemandOptions)
+				}
+				if input.SpotOptions != nil {
+					t.Fatalf("unexpected spot options")
+				}
+			}
+
+			overrides := input.LaunchTemplateConfigs[0].Overrides
+			if len(overrides) != len(instanceTypes)*len(subnets) {
+				t.Fatalf("expected %d overrides, got %d", len(instanceTypes)*len(subnets), len(overrides))
+			}
+			first := overrides[0]
+			if first.InstanceType != "m7i.large" || aws.ToString(first.SubnetId) != subnets[0] || aws.ToFloat64(first.WeightedCapacity) != 2 {
+				t.Fatalf("unexpected first override %+v", first)
+			}
+			if last := overrides[len(overrides)-1]; last.InstanceType != "m6i.large" || last.WeightedCapacity != nil {
+				t.Fatalf("unexpected last override %+v", last)
+			}
+		})
+	}
+}
+
+func TestFleetInputMaxTotalPrice(t *testing.T) {
+	runnerSpec := &spec.RunnerSpec{
+		InstanceTypes:        []spec.InstanceType{{InstanceType: "m7i.large"}},
+		InstanceRequirements: &spec.InstanceRequirements{MaxPrice: "0.2"},
+	}
+	input := fleetInput(runnerSpec, "lt-0123456789abcdef0", []string{"subnet-0123456789abcdef0"}, nil)
+	if aws.ToString(input.OnDemandOptions.MaxTotalPrice) != "0.2" {
+		t.Fatalf("expected on-demand max total price, got %+v", input.OnDemandOptions)
+	}
+
+	runnerSpec.SpotOptions = &spec.SpotOptions{}
+	input = fleetInput(runnerSpec, "lt-0123456789abcdef0", []string{"subnet-0123456789abcdef0"}, nil)
+	if aws.ToString(input.SpotOptions.MaxTotalPrice) != "0.2" {
+		t.Fatalf("expected spot max total price, got %+v", input.SpotOptions)
+	}
+}
+
+func TestFleetError(t *testing.T) {
+	err := fleetError([]types.CreateFleetError{
+		{ErrorCode: aws.String("InsufficientInstanceCapacity"), ErrorMessage: aws.String("no capacity in eu-central-1a")},
+		{ErrorCode: aws.String("InsufficientInstanceCapacity"), ErrorMessage: aws.String("no capacity in eu-central-1b")},
+	})
+	if !isAPIErrorCode(err, spotFallbackErrorCodes...) {
+		t.Fatalf("expected a spot fallback error code, got %v", err)
+	}
+	if !isRetryable(err) {
+		t.Fatalf("expected capacity errors to be retryable")
+	}
+
+	// The fallback must not depend on the order of the fleet errors.
+	err = fleetError([]types.CreateFleetError{
+		{ErrorCode: aws.String("InvalidParameterValue"), ErrorMessage: aws.String("m7g.large does not support the image")},
+		{ErrorCode: aws.String("InsufficientInstanceCapacity"), ErrorMessage: aws.String("no capacity in eu-central-1a")},
+	})
+	if !isAPIErrorCode(err, spotFallbackErrorCodes...) {
+		t.Fatalf("expected a spot fallback error code, got %v", err)
+	}
+
+	if err := fleetError(nil); err == nil {
+		t.Fatalf("expected an error without fleet errors")
+	}
+}
+
+func TestLaunchTemplateData(t *testing.T) {
+	input := &ec2.RunInstancesInput{
+		ImageId:          aws.String("ami-0123456789abcdef0"),
+		InstanceType:     "m7i.large",
+		SubnetId:         aws.String("subnet-0123456789abcdef0"),
+		SecurityGroupIds: []string{"sg-0123456789abcdef0"},
+		UserData:         aws.String("dXNlcmRhdGE="),
+		InstanceMarketOptions: &types.InstanceMarketOptionsRequest{
+			MarketType: types.MarketTypeSpot,
+		},
+		BlockDeviceMappings: []types.BlockDeviceMapping{
+			{
+				DeviceName: aws.String("/dev/sdf"),
+				Ebs: &types.EbsBlockDevice{
+					SnapshotId: aws.String("snap-0123456789abcdef0"),
+					VolumeType: types.VolumeTypeGp3,
+				},
+			},
+		},
+		TagSpecifications: []types.TagSpecification{
+			{
+				ResourceType: types.ResourceTypeInstance,
+				Tags:         []types.Tag{{Key: aws.String("Name"), Value: aws.String("garm-runner")}},
+			},
+		},
+	}
+
+	data := launchTemplateData(input)
+	if aws.ToString(data.ImageId) != "ami-0123456789abcdef0" || aws.ToString(data.UserData) != "dXNlcmRhdGE=" {
+		t.Fatalf("unexpected launch template data %+v", data)
+	}
+	if data.InstanceType != "" || data.InstanceMarketOptions != nil {
+		t.Fatalf("instance type and market options must be left to the fleet")
+	}
+	if len(data.BlockDeviceMappings) != 1 || aws.ToString(data.BlockDeviceMappings[0].Ebs.SnapshotId) != "snap-0123456789abcdef0" {
+		t.Fatalf("unexpected block device mappings %+v", data.BlockDeviceMappings)
+	}
+	if len(data.TagSpecifications) != 1 || data.TagSpecifications[0].ResourceType != types.ResourceTypeInstance {
+		t.Fatalf("unexpected tag specifications %+v", data.TagSpecifications)
+	}
+}
+
+func TestFleetClientTokenIgnoresCooldowns(t *testing.T) {
+	runnerSpec := &spec.RunnerSpec{
+		ControllerID:  "controller",
+		InstanceTypes: []spec.InstanceType{{InstanceType: "m7i.large"}, {InstanceType: "m6i.large"}},
+	}
+	subnets := []string{"subnet-0123456789abcdef0"}
+
+	all := fleetInput(runnerSpec, "lt-0123456789abcdef0", subnets, nil)
+	if again := fleetInput(runnerSpec, "lt-0123456789abcdef0", subnets, nil); aws.ToString(again.ClientToken) != aws.ToString(all.ClientToken) {
+		t.Fatalf("client token must be stable for retries")
+	}
+	skipped := fleetInput(runnerSpec, "lt-0123456789abcdef0", subnets, func(instanceType, subnetID string) bool {
+		return instanceType == "m7i.large"
+	})
+	if aws.ToString(skipped.ClientToken) != aws.ToString(all.ClientToken) {
+		t.Fatalf("client token must not change with the capacity cool-downs")
+	}
+	other := fleetInput(runnerSpec, "lt-0123456789abcdef0", append(subnets, "subnet-0fedcba9876543210"), nil)
+	if aws.ToString(other.ClientToken) == aws.ToString(all.ClientToken) {
+		t.Fatalf("client token must change with the candidate subnets")
+	}
+	if len(aws.ToString(all.ClientToken)) > 64 {
+		t.Fatalf("client token too long: %s", aws.ToString(all.ClientToken))
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/cloudbase/garm-provider-aws/internal/convert"
+	"github.com/cloudbase/garm-provider-aws/internal/spec"
+	garmErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-common/params"
+)
+
+// instanceTypesCacheTTL is how long instance types resolved from instance
+// requirements are reused. New instance types show up rarely.
+const instanceTypesCacheTTL = 24 * time.Hour
+
+// ResolveInstanceTypes returns the instance types matching the requirements,
+// newest generations first. Results are cached per region.
+func (a *AwsCli) ResolveInstanceTypes(ctx context.Context, osArch params.OSArch, requirements spec.InstanceRequirements) ([]spec.InstanceType, error) {
+	arch := convert.OSArchToArchitecture(osArch)
+	if arch == "" {
+		return nil, garmErrors.NewBadRequestError("unsupported architecture: %s", osArch)
+	}
+
+	cacheName := fmt.Sprintf("instance-types-%s", a.region)
+	cacheKey, err := instanceRequirementsKey(arch, requirements)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	found, err := a.cache.Load(cacheName, cacheKey, &names)
+	if err != nil {
+		// The cache is an optimization. Resolve the types again.
+		log.Printf("failed to load cached instance types: %s", err)
+	}
+	if !found {
+		names, err = a.getInstanceTypesFromRequirements(ctx, arch, requirements)
+		if err != nil {
+			return nil, err
+		}
+		if err := a.cache.Store(cacheName, cacheKey, names, instanceTypesCacheTTL); err != nil {
+			log.Printf("failed to cache instance types: %s", err)
+		}
+	}
+
+	if len(names) == 0 {
+		return nil, garmErrors.NewBadRequestError("no %s instance types match the instance requirements", arch)
+	}
+
+	sortByGeneration(names)
+	instanceTypes := make([]spec.InstanceType, 0, len(names))
+	for _, name := range names {
+		instanceTypes = append(instanceTypes, spec.InstanceType{InstanceType: name})
+	}
+	return instanceTypes, nil
+}
+
+func (a *AwsCli) getInstanceTypesFromRequirements(ctx context.Context, arch types.ArchitectureType, requirements spec.InstanceRequirements) ([]string, error) {
+	burstable := types.BurstablePerformanceExcluded
+	if requirements.AllowBurstable {
+		burstable = types.BurstablePerformanceIncluded
+	}
+
+	input := &ec2.GetInstanceTypesFromInstanceRequirementsInput{
+		ArchitectureTypes:   []types.ArchitectureType{arch},
+		VirtualizationTypes: []types.VirtualizationType{types.VirtualizationTypeHvm},
+		InstanceRequirements: &types.InstanceRequirementsRequest{
+			VCpuCount: &types.VCpuCountRangeRequest{
+				Min: aws.Int32(requirements.VCPUCount.Min),
+				Max: rangeMax(requirements.VCPUCount.Max),
+			},
+			MemoryMiB: &types.MemoryMiBRequest{
+				Min: aws.Int32(requirements.MemoryMiB.Min),
+				Max: rangeMax(requirements.MemoryMiB.Max),
+			},
+			BurstablePerformance:  burstable,
+			ExcludedInstanceTypes: requirements.ExcludedInstanceTypes,
+		},
+	}
+
+	var names []string
+	paginator := ec2.NewGetInstanceTypesFromInstanceRequirementsPaginator(&a.client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get instance types from instance requirements: %w", classifyError(err))
+		}
+		for _, instanceType := range page.InstanceTypes {
+			names = append(names, aws.ToString(instanceType.InstanceType))
+		}
+	}
+	return names, nil
+}
+
+func rangeMax(max int32) *int32 {
+	if max == 0 {
+		return nil
+	}
+	return aws.Int32(max)
+}
+
+// instanceRequirementsKey returns the cache key of a set of requirements.
+// The max price is applied at launch and does not change the matching types.
+func instanceRequirementsKey(arch types.ArchitectureType, requirements spec.InstanceRequirements) (string, error) {
+	requirements.MaxPrice = ""
+	data, err := json.Marshal(struct {
+		Arch         types.ArchitectureType
+		Requirements spec.InstanceRequirements
+	}{arch, requirements})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode instance requirements: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// instanceGeneration returns the generation of an instance type, eg: 7 for
+// m7i.large. Types without a generation number sort last.
+func instanceGeneration(instanceType string) int {
+	family, _, _ := strings.Cut(instanceType, ".")
+	generation := 0
+	started := false
+	for _, r := range family {
+		if unicode.IsDigit(r) {
+			generation = generation*10 + int(r-'0')
+			started = true
+		} else if started {
+			break
+		}
+	}
+	return generation
+}
+
+// sortByGeneration orders instance types newest generation first, so they
+// are preferred when the fleet orders by priority or the list is trimmed.
+func sortByGeneration(instanceTypes []string) {
+	sort.SliceStable(instanceTypes, func(i, j int) bool {
+		gi, gj := instanceGeneration(instanceTypes[i]), instanceGeneration(instanceTypes[j])
+		if gi != gj {
+			return gi > gj
+		}
+		return instanceTypes[i] < instanceTypes[j]
+	})
+}
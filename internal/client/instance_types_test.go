@@ -0,0 +1,58 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package client
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/cloudbase/garm-provider-aws/internal/spec"
+)
+
+func TestSortByGeneration(t *testing.T) {
+	instanceTypes := []string{"m5.large", "c6g.large", "m7i-flex.large", "m6i.large", "a1.large", "m7g.large", "mac.metal"}
+	sortByGeneration(instanceTypes)
+
+	expected := []string{"m7g.large", "m7i-flex.large", "c6g.large", "m6i.large", "m5.large", "a1.large", "mac.metal"}
+	if !reflect.DeepEqual(instanceTypes, expected) {
+		t.Fatalf("expected %v, got %v", expected, instanceTypes)
+	}
+}
+
+func TestInstanceRequirementsKey(t *testing.T) {
+	requirements := spec.InstanceRequirements{
+		VCPUCount: &spec.Range{Min: 2, Max: 4},
+		MemoryMiB: &spec.Range{Min: 4096},
+	}
+	key, err := instanceRequirementsKey(types.ArchitectureTypeX8664, requirements)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	withPrice := requirements
+	withPrice.MaxPrice = "0.1"
+	if other, _ := instanceRequirementsKey(types.ArchitectureTypeX8664, withPrice); other != key {
+		t.Fatalf("max price must not change the cache key")
+	}
+	if other, _ := instanceRequirementsKey(types.ArchitectureTypeArm64, requirements); other == key {
+		t.Fatalf("architecture must change the cache key")
+	}
+	withBurstable := requirements
+	withBurstable.AllowBurstable = true
+	if other, _ := instanceRequirementsKey(types.ArchitectureTypeX8664, withBurstable); other == key {
+		t.Fatalf("requirements must change the cache key")
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/cloudbase/garm-provider-aws/config"
+	"github.com/cloudbase/garm-provider-aws/internal/spec"
+	garmErrors "github.com/cloudbase/garm-provider-common/errors"
+)
+
+// runInstancesInput translates a runner spec into a RunInstances request.
+func (a *AwsCli) runInstancesInput(ctx context.Context, spec *spec.RunnerSpec) (*ec2.RunInstancesInput, error) {
+	input := &ec2.RunInstancesInput{
+		ImageId:           aws.String(spec.BootstrapParams.Image),
+		InstanceType:      types.InstanceType(spec.BootstrapParams.Flavor),
+		MaxCount:          aws.Int32(spec.MaxCount),
+		MinCount:          aws.Int32(spec.MinCount),
+		SubnetId:          aws.String(spec.SubnetID),
+		SecurityGroupIds:  spec.SecurityGroupIDs,
+		UserData:          aws.String(spec.UserData),
+		TagSpecifications: spec.TagSpecifications(),
+		ClientToken:       aws.String(spec.ClientToken()),
+	}
+
+	if spec.IAMInstanceProfile != "" {
+		input.IamInstanceProfile = &types.IamInstanceProfileSpecification{}
+		if strings.HasPrefix(spec.IAMInstanceProfile, "arn:") {
+			input.IamInstanceProfile.Arn = aws.String(spec.IAMInstanceProfile)
+		} else {
+			input.IamInstanceProfile.Name = aws.String(spec.IAMInstanceProfile)
+		}
+	}
+
+	if spec.KeyName != "" {
+		input.KeyName = aws.String(spec.KeyName)
+	}
+
+	if spec.Placement != nil || spec.Tenancy != "" {
+		input.Placement = &types.Placement{
+			Tenancy: types.Tenancy(spec.Tenancy),
+		}
+		if spec.Placement != nil {
+			if spec.Placement.AvailabilityZone != "" {
+				input.Placement.AvailabilityZone = aws.String(spec.Placement.AvailabilityZone)
+			}
+			if spec.Placement.GroupName != "" {
+				input.Placement.GroupName = aws.String(spec.Placement.GroupName)
+			}
+			if spec.Placement.HostID != "" {
+				input.Placement.HostId = aws.String(spec.Placement.HostID)
+			}
+		}
+	}
+
+	if spec.CreditSpecification != "" {
+		input.CreditSpecification = &types.CreditSpecificationRequest{
+			CpuCredits: aws.String(spec.CreditSpecification),
+		}
+	}
+
+	if opts := spec.MetadataOptions; opts != nil {
+		input.MetadataOptions = &types.InstanceMetadataOptionsRequest{
+			HttpTokens:           types.HttpTokensState(opts.HTTPTokens),
+			HttpEndpoint:         types.InstanceMetadataEndpointState(opts.HTTPEndpoint),
+			InstanceMetadataTags: types.InstanceMetadataTagsState(opts.InstanceMetadataTags),
+		}
+		if opts.HTTPPutResponseHopLimit != 0 {
+			input.MetadataOptions.HttpPutResponseHopLimit = aws.Int32(opts.HTTPPutResponseHopLimit)
+		}
+	}
+
+	if opts := spec.SpotOptions; opts != nil {
+		spotOptions := &types.SpotMarketOptions{
+			InstanceInterruptionBehavior: types.InstanceInterruptionBehavior(opts.InterruptionBehavior),
+		}
+		if opts.MaxPrice != "" {
+			spotOptions.MaxPrice = aws.String(opts.MaxPrice)
+		}
+		if opts.InterruptionBehavior != "" && opts.InterruptionBehavior != string(types.InstanceInterruptionBehaviorTerminate) {
+			// Stopping or hibernating on interruption needs a persistent request.
+			spotOptions.SpotInstanceType = types.SpotInstanceTypePersistent
+		}
+		input.InstanceMarketOptions = &types.InstanceMarketOptionsRequest{
+			MarketType:  types.MarketTypeSpot,
+			SpotOptions: spotOptions,
+		}
+	}
+
+	if spec.Hibernate {
+		input.HibernationOptions = &types.HibernationOptionsRequest{
+			Configured: aws.Bool(true),
+		}
+	}
+
+	if !spec.RootVolume.IsZero() || spec.Hibernate || len(spec.DataVolumes) > 0 {
+		image, err := a.describeImage(ctx, spec.BootstrapParams.Image)
+		if err != nil {
+			return nil, err
+		}
+		rootVolume, err := a.rootBlockDeviceMapping(ctx, spec, image)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure root volume: %w", err)
+		}
+		input.BlockDeviceMappings = []types.BlockDeviceMapping{rootVolume}
+
+		for _, volume := range spec.DataVolumes {
+			if volume.DeviceName == aws.ToString(image.RootDeviceName) {
+				return nil, garmErrors.NewBadRequestError("data volume %s conflicts with the root device of the image", volume.DeviceName)
+			}
+			ebs := ebsBlockDevice(volume)
+			if volume.VolumeType == "" {
+				// EC2 defaults new volumes to gp2, but the limits of data
+				// volumes are validated as gp3.
+				ebs.VolumeType = types.VolumeTypeGp3
+			}
+			if volume.HasSnapshot() {
+				snapshot, err := a.resolveSnapshot(ctx, volume)
+				if err != nil {
+					return nil, fmt.Errorf("failed to configure data volume %s: %w", volume.DeviceName, err)
+				}
+				if volume.SizeGB > 0 && volume.SizeGB < aws.ToInt32(snapshot.VolumeSize) {
+					return nil, garmErrors.NewBadRequestError("data volume %s size %d GiB is smaller than the %d GiB snapshot", volume.DeviceName, volume.SizeGB, aws.ToInt32(snapshot.VolumeSize))
+				}
+				ebs.SnapshotId = snapshot.SnapshotId
+			}
+			input.BlockDeviceMappings = append(input.BlockDeviceMappings, types.BlockDeviceMapping{
+				DeviceName: aws.String(volume.DeviceName),
+				Ebs:        ebs,
+			})
+		}
+	}
+
+	return input, nil
+}
+
+// rootBlockDeviceMapping returns the root volume mapping of the runner. When
+// hibernating, RAM is written to the root volume, which must then be encrypted
+// and large enough to hold both the AMI contents and the RAM of the flavor.
+func (a *AwsCli) rootBlockDeviceMapping(ctx context.Context, spec *spec.RunnerSpec, image types.Image) (types.BlockDeviceMapping, error) {
+	var imageSizeGiB int32
+	for _, mapping := range image.BlockDeviceMappings {
+		if aws.ToString(mapping.DeviceName) == aws.ToString(image.RootDeviceName) && mapping.Ebs != nil {
+			imageSizeGiB = aws.ToInt32(mapping.Ebs.VolumeSize)
+		}
+	}
+
+	if size := spec.RootVolume.SizeGB; size > 0 && size < imageSizeGiB {
+		return types.BlockDeviceMapping{}, garmErrors.NewBadRequestError("root volume size %d GiB is smaller than the %d GiB image", size, imageSizeGiB)
+	}
+	ebs := ebsBlockDevice(spec.RootVolume)
+
+	if spec.Hibernate {
+		instanceType, err := a.describeInstanceType(ctx, spec.BootstrapParams.Flavor)
+		if err != nil {
+			return types.BlockDeviceMapping{}, err
+		}
+		if !aws.ToBool(instanceType.HibernationSupported) {
+			return types.BlockDeviceMapping{}, garmErrors.NewBadRequestError("instance type %s does not support hibernation", spec.BootstrapParams.Flavor)
+		}
+
+		var memoryMiB int64
+		if instanceType.MemoryInfo != nil {
+			memoryMiB = aws.ToInt64(instanceType.MemoryInfo.SizeInMiB)
+		}
+		minSize := imageSizeGiB + int32((memoryMiB+1023)/1024)
+		if aws.ToInt32(ebs.VolumeSize) < minSize {
+			ebs.VolumeSize = aws.Int32(minSize)
+		}
+		ebs.Encrypted = aws.Bool(true)
+	}
+
+	return types.BlockDeviceMapping{
+		DeviceName: image.RootDeviceName,
+		Ebs:        ebs,
+	}, nil
+}
+
+// ebsBlockDevice converts a volume from the config or extra specs to an EBS
+// block device. Volumes are deleted on termination unless configured otherwise.
+func ebsBlockDevice(volume config.EBSVolume) *types.EbsBlockDevice {
+	ebs := &types.EbsBlockDevice{
+		DeleteOnTermination: aws.Bool(true),
+		VolumeType:          types.VolumeType(volume.VolumeType),
+		Encrypted:           volume.Encrypted,
+	}
+	if volume.DeleteOnTermination != nil {
+		ebs.DeleteOnTermination = volume.DeleteOnTermination
+	}
+	if volume.SizeGB > 0 {
+		ebs.VolumeSize = aws.Int32(volume.SizeGB)
+	}
+	if volume.IOPS > 0 {
+		ebs.Iops = aws.Int32(volume.IOPS)
+	}
+	if volume.Throughput > 0 {
+		ebs.Throughput = aws.Int32(volume.Throughput)
+	}
+	if volume.KMSKeyID != "" {
+		ebs.KmsKeyId = aws.String(volume.KMSKeyID)
+	}
+	return ebs
+}
+
+// resolveSnapshot returns the snapshot a data volume is restored from. When
+// the volume names snapshot tags instead of an ID, the most recent completed
+// snapshot owned by the account that carries all of them is used.
+func (a *AwsCli) resolveSnapshot(ctx context.Context, volume config.EBSVolume) (types.Snapshot, error) {
+	input := &ec2.DescribeSnapshotsInput{
+		Filters: []types.Filter{
+			{
+				Name:   aws.String("status"),
+				Values: []string{string(types.SnapshotStateCompleted)},
+			},
+		},
+	}
+	if volume.SnapshotID != "" {
+		input.SnapshotIds = []string{volume.SnapshotID}
+	} else {
+		input.OwnerIds = []string{"self"}
+		for key, value := range volume.SnapshotTags {
+			input.Filters = append(input.Filters, types.Filter{
+				Name:   aws.String(fmt.Sprintf("tag:%s", key)),
+				Values: []string{value},
+			})
+		}
+	}
+
+	var latest *types.Snapshot
+	paginator := ec2.NewDescribeSnapshotsPaginator(&a.client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return types.Snapshot{}, fmt.Errorf("failed to describe snapshots: %w", classifyError(err))
+		}
+		for idx, snapshot := range page.Snapshots {
+			if latest == nil || aws.ToTime(snapshot.StartTime).After(aws.ToTime(latest.StartTime)) {
+				latest = &page.Snapshots[idx]
+			}
+		}
+	}
+
+	if latest == nil {
+		if volume.SnapshotID != "" {
+			return types.Snapshot{}, garmErrors.NewBadRequestError("snapshot %s not found or not completed", volume.SnapshotID)
+		}
+		return types.Snapshot{}, garmErrors.NewBadRequestError("no completed snapshot found with tags %v", volume.SnapshotTags)
+	}
+	return *latest, nil
+}
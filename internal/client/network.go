@@ -0,0 +1,608 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/cloudbase/garm-provider-aws/internal/util"
+)
+
+const (
+	vpcName         = "GARM-VPC"
+	igwName         = "GARM-IGW"
+	routeTableName  = "GARM-RT"
+	subnetName      = "GARM-SUBNET"
+	defaultRouteDst = "0.0.0.0/0"
+
+	// resourceTypeIgwAttachment marks the detach step of an internet gateway.
+	resourceTypeIgwAttachment = "internet-gateway-attachment"
+)
+
+// ManagedNetwork holds the IDs of the network resources shared by all runners
+// of a controller when the provider manages the network.
+type ManagedNetwork struct {
+	VpcID             string
+	InternetGatewayID string
+	RouteTableID      string
+	SubnetID          string
+}
+
+// EnsureManagedNetwork looks up the controller VPC, internet gateway, route
+// table and subnet, creating only the ones that are missing. Several provider
+// processes may run this at the same time. Each of them converges on the
+// resource with the lowest ID and deletes any duplicate it created itself.
+func (a *AwsCli) EnsureManagedNetwork(ctx context.Context, vpcCIDR, subnetCIDR string) (ManagedNetwork, error) {
+	var network ManagedNetwork
+	var err error
+
+	network.VpcID, err = a.ensureVpc(ctx, vpcCIDR)
+	if err != nil {
+		return ManagedNetwork{}, fmt.Errorf("failed to ensure VPC: %w", err)
+	}
+
+	network.InternetGatewayID, err = a.ensureInternetGateway(ctx, network.VpcID)
+	if err != nil {
+		return ManagedNetwork{}, fmt.Errorf("failed to ensure internet gateway: %w", err)
+	}
+
+	network.RouteTableID, err = a.ensureRouteTable(ctx, network.VpcID, network.InternetGatewayID)
+	if err != nil {
+		return ManagedNetwork{}, fmt.Errorf("failed to ensure route table: %w", err)
+	}
+
+	network.SubnetID, err = a.ensureSubnet(ctx, network.VpcID, subnetCIDR)
+	if err != nil {
+		return ManagedNetwork{}, fmt.Errorf("failed to ensure subnet: %w", err)
+	}
+
+	if err := a.ensureRouteTableAssociation(ctx, network.RouteTableID, network.SubnetID); err != nil {
+		return ManagedNetwork{}, fmt.Errorf("failed to associate route table: %w", err)
+	}
+
+	return network, nil
+}
+
+// networkTagSpecifications returns the tags applied to managed network
+// resources at creation.
+func (a *AwsCli) networkTagSpecifications(resourceType types.ResourceType, name string) []types.TagSpecification {
+	return []types.TagSpecification{
+		{
+			ResourceType: resourceType,
+			Tags: []types.Tag{
+				{
+					Key:   aws.String(util.NameTagName),
+					Value: aws.String(name),
+				},
+				{
+					Key:   aws.String(util.ControllerIDTagName),
+					Value: aws.String(a.controllerID),
+				},
+			},
+		},
+	}
+}
+
+// networkFilters returns the filters matching managed network resources with
+// the given name belonging to this controller.
+func (a *AwsCli) networkFilters(name string, extra ...types.Filter) []types.Filter {
+	filters := []types.Filter{
+		{
+			Name:   aws.String("tag:" + util.NameTagName),
+			Values: []string{name},
+		},
+		{
+			Name:   aws.String("tag:" + util.ControllerIDTagName),
+			Values: []string{a.controllerID},
+		},
+	}
+	return append(filters, extra...)
+}
+
+// pickWinner deterministically picks one ID out of the candidates, so that
+// concurrent processes agree on the same resource.
+func pickWinner(ids []string) string {
+	if len(ids) == 0 {
+		return ""
+	}
+	sorted := append([]string(nil), ids...)
+	sort.Strings(sorted)
+	return sorted[0]
+}
+
+func (a *AwsCli) findVpcs(ctx context.Context) ([]string, error) {
+	var ids []string
+	paginator := ec2.NewDescribeVpcsPaginator(&a.client, &ec2.DescribeVpcsInput{
+		Filters: a.networkFilters(vpcName),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe VPCs: %w", classifyError(err))
+		}
+		for _, vpc := range page.Vpcs {
+			ids = append(ids, aws.ToString(vpc.VpcId))
+		}
+	}
+	return ids, nil
+}
+
+func (a *AwsCli) ensureVpc(ctx context.Context, cidr string) (string, error) {
+	ids, err := a.findVpcs(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(ids) > 0 {
+		return pickWinner(ids), nil
+	}
+
+	resp, err := a.client.CreateVpc(ctx, &ec2.CreateVpcInput{
+		CidrBlock:         aws.String(cidr),
+		TagSpecifications: a.networkTagSpecifications(types.ResourceTypeVpc, vpcName),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create VPC: %w", classifyError(err))
+	}
+	ownID := aws.ToString(resp.Vpc.VpcId)
+
+	ids, err = a.findVpcs(ctx)
+	if err != nil {
+		return "", err
+	}
+	winner := pickWinner(append(ids, ownID))
+	if winner != ownID {
+		// Another process created a VPC at the same time. Use theirs.
+		if _, err := a.client.DeleteVpc(ctx, &ec2.DeleteVpcInput{VpcId: aws.String(ownID)}); err != nil {
+			return "", fmt.Errorf("failed to delete duplicate VPC %s: %w", ownID, classifyError(err))
+		}
+	}
+	return winner, nil
+}
+
+func (a *AwsCli) findInternetGateways(ctx context.Context, vpcID string) ([]string, error) {
+	var ids []string
+	paginator := ec2.NewDescribeInternetGatewaysPaginator(&a.client, &ec2.DescribeInternetGatewaysInput{
+		Filters: []types.Filter{
+			{
+				Name:   aws.String("attachment.vpc-id"),
+				Values: []string{vpcID},
+			},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe internet gateways: %w", classifyError(err))
+		}
+		for _, igw := range page.InternetGateways {
+			ids = append(ids, aws.ToString(igw.InternetGatewayId))
+		}
+	}
+	return ids, nil
+}
+
+// ensureInternetGateway returns the internet gateway attached to the VPC,
+// creating and attaching one if needed. A VPC can only have one internet
+// gateway attached, so losing an attach race means another process won.
+func (a *AwsCli) ensureInternetGateway(ctx context.Context, vpcID string) (string, error) {
+	ids, err := a.findInternetGateways(ctx, vpcID)
+	if err != nil {
+		return "", err
+	}
+	if len(ids) > 0 {
+		return ids[0], nil
+	}
+
+	resp, err := a.client.CreateInternetGateway(ctx, &ec2.CreateInternetGatewayInput{
+		TagSpecifications: a.networkTagSpecifications(types.ResourceTypeInternetGateway, igwName),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create internet gateway: %w", classifyError(err))
+	}
+	ownID := aws.ToString(resp.InternetGateway.InternetGatewayId)
+
+	_, err = a.client.AttachInternetGateway(ctx, &ec2.AttachInternetGatewayInput{
+		InternetGatewayId: aws.String(ownID),
+		VpcId:             aws.String(vpcID),
+	})
+	if err == nil {
+		return ownID, nil
+	}
+	if !isAPIErrorCode(err, "Resource.AlreadyAssociated") {
+		attachErr := fmt.Errorf("failed to attach internet gateway: %w", classifyError(err))
+		if _, err := a.client.DeleteInternetGateway(ctx, &ec2.DeleteInternetGatewayInput{InternetGatewayId: aws.String(ownID)}); err != nil {
+			return "", errors.Join(attachErr, fmt.Errorf("failed to delete internet gateway %s: %w", ownID, classifyError(err)))
+		}
+		return "", attachErr
+	}
+
+	if _, err := a.client.DeleteInternetGateway(ctx, &ec2.DeleteInternetGatewayInput{InternetGatewayId: aws.String(ownID)}); err != nil {
+		return "", fmt.Errorf("failed to delete duplicate internet gateway %s: %w", ownID, classifyError(err))
+	}
+	ids, err = a.findInternetGateways(ctx, vpcID)
+	if err != nil {
+		return "", err
+	}
+	if len(ids) == 0 {
+		return "", fmt.Errorf("no internet gateway attached to VPC %s", vpcID)
+	}
+	return ids[0], nil
+}
+
+func (a *AwsCli) findRouteTables(ctx context.Context, vpcID string) ([]types.RouteTable, error) {
+	var routeTables []types.RouteTable
+	paginator := ec2.NewDescribeRouteTablesPaginator(&a.client, &ec2.DescribeRouteTablesInput{
+		Filters: a.networkFilters(routeTableName, types.Filter{
+			Name:   aws.String("vpc-id"),
+			Values: []string{vpcID},
+		}),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe route tables: %w", classifyError(err))
+		}
+		routeTables = append(routeTables, page.RouteTables...)
+	}
+	return routeTables, nil
+}
+
+func routeTableIDs(routeTables []types.RouteTable) []string {
+	ids := make([]string, 0, len(routeTables))
+	for _, rt := range routeTables {
+		ids = append(ids, aws.ToString(rt.RouteTableId))
+	}
+	return ids
+}
+
+// ensureRouteTable returns the controller route table of the VPC, creating it
+// if needed, and makes sure it has a default route through the internet gateway.
+func (a *AwsCli) ensureRouteTable(ctx context.Context, vpcID, igwID string) (string, error) {
+	routeTables, err := a.findRouteTables(ctx, vpcID)
+	if err != nil {
+		return "", err
+	}
+
+	routeTableID := pickWinner(routeTableIDs(routeTables))
+	if routeTableID == "" {
+		resp, err := a.client.CreateRouteTable(ctx, &ec2.CreateRouteTableInput{
+			VpcId:             aws.String(vpcID),
+			TagSpecifications: a.networkTagSpecifications(types.ResourceTypeRouteTable, routeTableName),
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to create route table: %w", classifyError(err))
+		}
+		ownID := aws.ToString(resp.RouteTable.RouteTableId)
+
+		routeTables, err = a.findRouteTables(ctx, vpcID)
+		if err != nil {
+			return "", err
+		}
+		routeTableID = pickWinner(append(routeTableIDs(routeTables), ownID))
+		if routeTableID != ownID {
+			if _, err := a.client.DeleteRouteTable(ctx, &ec2.DeleteRouteTableInput{RouteTableId: aws.String(ownID)}); err != nil {
+				return "", fmt.Errorf("failed to delete duplicate route table %s: %w", ownID, classifyError(err))
+			}
+		}
+	}
+
+	_, err = a.client.CreateRoute(ctx, &ec2.CreateRouteInput{
+		RouteTableId:         aws.String(routeTableID),
+		DestinationCidrBlock: aws.String(defaultRouteDst),
+		GatewayId:            aws.String(igwID),
+	})
+	if err != nil && !isAPIErrorCode(err, "RouteAlreadyExists") {
+		return "", fmt.Errorf("failed to create default route: %w", classifyError(err))
+	}
+
+	return routeTableID, nil
+}
+
+func (a *AwsCli) findSubnets(ctx context.Context, vpcID string) ([]string, error) {
+	var ids []string
+	paginator := ec2.NewDescribeSubnetsPaginator(&a.client, &ec2.DescribeSubnetsInput{
+		Filters: a.networkFilters(subnetName, types.Filter{
+			Name:   aws.String("vpc-id"),
+			Values: []string{vpcID},
+		}),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe subnets: %w", classifyError(err))
+		}
+		for _, subnet := range page.Subnets {
+			ids = append(ids, aws.ToString(subnet.SubnetId))
+		}
+	}
+	return ids, nil
+}
+
+// ensureSubnet returns the controller subnet of the VPC, creating it if
+// needed. Subnet CIDRs cannot overlap, so losing a create race surfaces as
+// a conflict and we use the subnet the other process created.
+func (a *AwsCli) ensureSubnet(ctx context.Context, vpcID, cidr string) (string, error) {
+	subnetID, err := a.findOrCreateSubnet(ctx, vpcID, cidr)
+	if err != nil {
+		return "", err
+	}
+
+	// Runners need a public address to reach GitHub through the internet gateway.
+	_, err = a.client.ModifySubnetAttribute(ctx, &ec2.ModifySubnetAttributeInput{
+		SubnetId:            aws.String(subnetID),
+		MapPublicIpOnLaunch: &types.AttributeBooleanValue{Value: aws.Bool(true)},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to enable public IPs on subnet: %w", classifyError(err))
+	}
+
+	return subnetID, nil
+}
+
+func (a *AwsCli) findOrCreateSubnet(ctx context.Context, vpcID, cidr string) (string, error) {
+	ids, err := a.findSubnets(ctx, vpcID)
+	if err != nil {
+		return "", err
+	}
+	if len(ids) > 0 {
+		return pickWinner(ids), nil
+	}
+
+	resp, err := a.client.CreateSubnet(ctx, &ec2.CreateSubnetInput{
+		CidrBlock:         aws.String(cidr),
+		VpcId:             aws.String(vpcID),
+		TagSpecifications: a.networkTagSpecifications(types.ResourceTypeSubnet, subnetName),
+	})
+	if err == nil {
+		return aws.ToString(resp.Subnet.SubnetId), nil
+	}
+	if !isAPIErrorCode(err, "InvalidSubnet.Conflict") {
+		return "", fmt.Errorf("failed to create subnet: %w", classifyError(err))
+	}
+
+	ids, err = a.findSubnets(ctx, vpcID)
+	if err != nil {
+		return "", err
+	}
+	if len(ids) == 0 {
+		return "", fmt.Errorf("subnet %s conflicts with a subnet not managed by garm", cidr)
+	}
+	return pickWinner(ids), nil
+}
+
+func (a *AwsCli) ensureRouteTableAssociation(ctx context.Context, routeTableID, subnetID string) error {
+	_, err := a.client.AssociateRouteTable(ctx, &ec2.AssociateRouteTableInput{
+		RouteTableId: aws.String(routeTableID),
+		SubnetId:     aws.String(subnetID),
+	})
+	if err != nil && !isAPIErrorCode(err, "Resource.AlreadyAssociated") {
+		return fmt.Errorf("failed to associate route table: %w", classifyError(err))
+	}
+	return nil
+}
+
+// NetworkResource identifies a managed network resource.
+type NetworkResource struct {
+	Type string
+	ID   string
+	// VpcID is the VPC the resource belongs to.
+	VpcID string
+}
+
+func (n NetworkResource) String() string {
+	return fmt.Sprintf("%s %s (vpc %s)", n.Type, n.ID, n.VpcID)
+}
+
+// CleanupManagedNetwork removes the network resources created by this
+// controller which no longer host any instances, including managed runner
+// security groups in other VPCs. Resources are removed in dependency order
+// and returned in that same order. When dryRun is set,
+// nothing is removed and the returned list describes what would be.
+func (a *AwsCli) CleanupManagedNetwork(ctx context.Context, dryRun bool) ([]NetworkResource, error) {
+	vpcIDs, err := a.findVpcs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		removed []NetworkResource
+		errs    []error
+	)
+	for _, vpcID := range vpcIDs {
+		inUse, err := a.vpcHasInstances(ctx, vpcID)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if inUse {
+			continue
+		}
+
+		resources, err := a.collectVpcResources(ctx, vpcID)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if dryRun {
+			removed = append(removed, resources...)
+			continue
+		}
+
+		for _, resource := range resources {
+			if err := a.deleteNetworkResource(ctx, resource); err != nil {
+				// Later resources depend on this one being gone.
+				errs = append(errs, fmt.Errorf("failed to delete %s: %w", resource, err))
+				break
+			}
+			removed = append(removed, resource)
+		}
+	}
+
+	// The managed runner security group may also live in VPCs that are not
+	// managed by the provider.
+	groups, err := a.collectRunnerSecurityGroups(ctx, vpcIDs)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for _, group := range groups {
+		inUse, err := a.securityGroupInUse(ctx, group.ID)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if inUse {
+			continue
+		}
+		if !dryRun {
+			if err := a.deleteNetworkResource(ctx, group); err != nil {
+				errs = append(errs, fmt.Errorf("failed to delete %s: %w", group, err))
+				continue
+			}
+		}
+		removed = append(removed, group)
+	}
+
+	if len(errs) > 0 {
+		return removed, fmt.Errorf("failed to clean up network: %w", errors.Join(errs...))
+	}
+	return removed, nil
+}
+
+// vpcHasInstances returns true if any non-terminated instance, garm managed
+// or not, still lives in the VPC.
+func (a *AwsCli) vpcHasInstances(ctx context.Context, vpcID string) (bool, error) {
+	resp, err := a.client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{
+			{
+				Name:   aws.String("vpc-id"),
+				Values: []string{vpcID},
+			},
+			{
+				Name:   aws.String("instance-state-name"),
+				Values: activeInstanceStates,
+			},
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to list instances in VPC %s: %w", vpcID, classifyError(err))
+	}
+	for _, reservation := range resp.Reservations {
+		if len(reservation.Instances) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// collectVpcResources returns the resources of a managed VPC in the order
+// they need to be removed.
+func (a *AwsCli) collectVpcResources(ctx context.Context, vpcID string) ([]NetworkResource, error) {
+	igwIDs, err := a.findInternetGateways(ctx, vpcID)
+	if err != nil {
+		return nil, err
+	}
+	subnetIDs, err := a.findSubnets(ctx, vpcID)
+	if err != nil {
+		return nil, err
+	}
+	routeTables, err := a.findRouteTables(ctx, vpcID)
+	if err != nil {
+		return nil, err
+	}
+	securityGroupIDs, err := a.findSecurityGroups(ctx, vpcID)
+	if err != nil {
+		return nil, err
+	}
+
+	var resources []NetworkResource
+	for _, id := range igwIDs {
+		resources = append(resources, NetworkResource{Type: resourceTypeIgwAttachment, ID: id, VpcID: vpcID})
+	}
+	for _, id := range subnetIDs {
+		resources = append(resources, NetworkResource{Type: string(types.ResourceTypeSubnet), ID: id, VpcID: vpcID})
+	}
+	for _, id := range routeTableIDs(routeTables) {
+		resources = append(resources, NetworkResource{Type: string(types.ResourceTypeRouteTable), ID: id, VpcID: vpcID})
+	}
+	for _, id := range securityGroupIDs {
+		resources = append(resources, NetworkResource{Type: string(types.ResourceTypeSecurityGroup), ID: id, VpcID: vpcID})
+	}
+	for _, id := range igwIDs {
+		resources = append(resources, NetworkResource{Type: string(types.ResourceTypeInternetGateway), ID: id, VpcID: vpcID})
+	}
+	resources = append(resources, NetworkResource{Type: string(types.ResourceTypeVpc), ID: vpcID, VpcID: vpcID})
+
+	return resources, nil
+}
+
+// findSecurityGroups returns the controller owned security groups of the VPC.
+func (a *AwsCli) findSecurityGroups(ctx context.Context, vpcID string) ([]string, error) {
+	var ids []string
+	paginator := ec2.NewDescribeSecurityGroupsPaginator(&a.client, &ec2.DescribeSecurityGroupsInput{
+		Filters: []types.Filter{
+			{
+				Name:   aws.String("vpc-id"),
+				Values: []string{vpcID},
+			},
+			{
+				Name:   aws.String("tag:" + util.ControllerIDTagName),
+				Values: []string{a.controllerID},
+			},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe security groups: %w", classifyError(err))
+		}
+		for _, group := range page.SecurityGroups {
+			ids = append(ids, aws.ToString(group.GroupId))
+		}
+	}
+	return ids, nil
+}
+
+func (a *AwsCli) deleteNetworkResource(ctx context.Context, resource NetworkResource) error {
+	var err error
+	switch resource.Type {
+	case resourceTypeIgwAttachment:
+		_, err = a.client.DetachInternetGateway(ctx, &ec2.DetachInternetGatewayInput{
+			InternetGatewayId: aws.String(resource.ID),
+			VpcId:             aws.String(resource.VpcID),
+		})
+	case string(types.ResourceTypeSubnet):
+		_, err = a.client.DeleteSubnet(ctx, &ec2.DeleteSubnetInput{SubnetId: aws.String(resource.ID)})
+	case string(types.ResourceTypeRouteTable):
+		_, err = a.client.DeleteRouteTable(ctx, &ec2.DeleteRouteTableInput{RouteTableId: aws.String(resource.ID)})
+	case string(types.ResourceTypeSecurityGroup):
+		_, err = a.client.DeleteSecurityGroup(ctx, &ec2.DeleteSecurityGroupInput{GroupId: aws.String(resource.ID)})
+	case string(types.ResourceTypeInternetGateway):
+		_, err = a.client.DeleteInternetGateway(ctx, &ec2.DeleteInternetGatewayInput{InternetGatewayId: aws.String(resource.ID)})
+	case string(types.ResourceTypeVpc):
+		_, err = a.client.DeleteVpc(ctx, &ec2.DeleteVpcInput{VpcId: aws.String(resource.ID)})
+	default:
+		return fmt.Errorf("unknown resource type %s", resource.Type)
+	}
+	if err != nil {
+		return classifyError(err)
+	}
+	return nil
+}
@@ -0,0 +1,354 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/cloudbase/garm-provider-aws/config"
+	"github.com/cloudbase/garm-provider-aws/internal/spec"
+	garmErrors "github.com/cloudbase/garm-provider-common/errors"
+)
+
+const (
+	// runnerSecurityGroupName is the Name tag of the managed runner
+	// security group.
+	runnerSecurityGroupName = "GARM-RUNNERS"
+
+	sshPort        = 22
+	winRMHTTPPort  = 5985
+	winRMHTTPSPort = 5986
+)
+
+// ResolveSecurityGroups sets the security group IDs the runner is launched
+// with. Security group names are looked up in the VPC of the runner subnets.
+// Runners without any security group get the managed runner security group,
+// if enabled, instead of the default group of the VPC.
+func (a *AwsCli) ResolveSecurityGroups(ctx context.Context, spec *spec.RunnerSpec) error {
+	useManaged := len(spec.SecurityGroupIDs) == 0 && len(spec.SecurityGroupNames) == 0 && a.cfg.ManagedSecurityGroup.Enabled
+	if len(spec.SecurityGroupNames) == 0 && !useManaged {
+		return nil
+	}
+
+	vpcID, err := a.subnetsVpc(ctx, spec.CandidateSubnets())
+	if err != nil {
+		return err
+	}
+
+	if useManaged {
+		groupID, err := a.ensureRunnerSecurityGroup(ctx, vpcID)
+		if err != nil {
+			return fmt.Errorf("failed to ensure runner security group: %w", err)
+		}
+		spec.SecurityGroupIDs = []string{groupID}
+		return nil
+	}
+
+	groupIDs, err := a.securityGroupIDsByName(ctx, vpcID, spec.SecurityGroupNames)
+	if err != nil {
+		return err
+	}
+	// Don't append to the slice shared with the config.
+	spec.SecurityGroupIDs = append(append([]string(nil), spec.SecurityGroupIDs...), groupIDs...)
+	spec.SecurityGroupNames = nil
+	return nil
+}
+
+// subnetsVpc returns the VPC of the subnets. Security groups belong to a
+// VPC, so all subnets of a runner must be in the same one.
+func (a *AwsCli) subnetsVpc(ctx context.Context, subnetIDs []string) (string, error) {
+	if len(subnetIDs) == 0 {
+		return "", fmt.Errorf("no subnet configured for runner")
+	}
+
+	vpcs := map[string]bool{}
+	paginator := ec2.NewDescribeSubnetsPaginator(&a.client, &ec2.DescribeSubnetsInput{
+		SubnetIds: subnetIDs,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to describe subnets: %w", classifyError(err))
+		}
+		for _, subnet := range page.Subnets {
+			vpcs[aws.ToString(subnet.VpcId)] = true
+		}
+	}
+
+	if len(vpcs) != 1 {
+		return "", garmErrors.NewBadRequestError("subnets %s must belong to a single VPC", strings.Join(subnetIDs, ", "))
+	}
+	for vpcID := range vpcs {
+		return vpcID, nil
+	}
+	return "", nil
+}
+
+// securityGroupIDsByName returns the IDs of the named security groups of
+// the VPC, in the order of the names.
+func (a *AwsCli) securityGroupIDsByName(ctx context.Context, vpcID string, names []string) ([]string, error) {
+	byName := map[string]string{}
+	paginator := ec2.NewDescribeSecurityGroupsPaginator(&a.client, &ec2.DescribeSecurityGroupsInput{
+		Filters: []types.Filter{
+			{
+				Name:   aws.String("vpc-id"),
+				Values: []string{vpcID},
+			},
+			{
+				Name:   aws.String("group-name"),
+				Values: names,
+			},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe security groups: %w", classifyError(err))
+		}
+		for _, group := range page.SecurityGroups {
+			byName[aws.ToString(group.GroupName)] = aws.ToString(group.GroupId)
+		}
+	}
+
+	ids := make([]string, 0, len(names))
+	for _, name := range names {
+		id, ok := byName[name]
+		if !ok {
+			return nil, garmErrors.NewBadRequestError("security group %s not found in VPC %s", name, vpcID)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// runnerSecurityGroupGroupName is the group name of the managed runner
+// security group. Group names are unique per VPC, which keeps concurrent
+// processes from creating more than one group.
+func (a *AwsCli) runnerSecurityGroupGroupName() string {
+	return fmt.Sprintf("garm-runners-%s", a.controllerID)
+}
+
+func (a *AwsCli) findRunnerSecurityGroups(ctx context.Context, extra ...types.Filter) ([]types.SecurityGroup, error) {
+	var groups []types.SecurityGroup
+	paginator := ec2.NewDescribeSecurityGroupsPaginator(&a.client, &ec2.DescribeSecurityGroupsInput{
+		Filters: a.networkFilters(runnerSecurityGroupName, extra...),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe security groups: %w", classifyError(err))
+		}
+		groups = append(groups, page.SecurityGroups...)
+	}
+	return groups, nil
+}
+
+// ensureRunnerSecurityGroup returns the managed runner security group of the
+// VPC, creating it if needed, and makes sure its ingress rules match the
+// config. New security groups only allow egress.
+func (a *AwsCli) ensureRunnerSecurityGroup(ctx context.Context, vpcID string) (string, error) {
+	vpcFilter := types.Filter{
+		Name:   aws.String("vpc-id"),
+		Values: []string{vpcID},
+	}
+	groups, err := a.findRunnerSecurityGroups(ctx, vpcFilter)
+	if err != nil {
+		return "", err
+	}
+
+	var group types.SecurityGroup
+	if len(groups) > 0 {
+		group = groups[0]
+	} else {
+		resp, err := a.client.CreateSecurityGroup(ctx, &ec2.CreateSecurityGroupInput{
+			GroupName:         aws.String(a.runnerSecurityGroupGroupName()),
+			Description:       aws.String(fmt.Sprintf("Runners of garm controller %s", a.controllerID)),
+			VpcId:             aws.String(vpcID),
+			TagSpecifications: a.networkTagSpecifications(types.ResourceTypeSecurityGroup, runnerSecurityGroupName),
+		})
+		switch {
+		case err == nil:
+			group.GroupId = resp.GroupId
+		case isAPIErrorCode(err, "InvalidGroup.Duplicate"):
+			// Another process created the group at the same time.
+			groups, err := a.findRunnerSecurityGroups(ctx, vpcFilter)
+			if err != nil {
+				return "", err
+			}
+			if len(groups) == 0 {
+				return "", fmt.Errorf("security group %s exists in VPC %s but is not managed by garm", a.runnerSecurityGroupGroupName(), vpcID)
+			}
+			group = groups[0]
+		default:
+			return "", fmt.Errorf("failed to create security group: %w", classifyError(err))
+		}
+	}
+
+	groupID := aws.ToString(group.GroupId)
+	add, remove := diffIngressRules(ingressRules(group.IpPermissions), desiredIngressRules(a.cfg.ManagedSecurityGroup))
+	if len(add) > 0 {
+		_, err := a.client.AuthorizeSecurityGroupIngress(ctx, &ec2.AuthorizeSecurityGroupIngressInput{
+			GroupId:       aws.String(groupID),
+			IpPermissions: ingressPermissions(add),
+		})
+		if err != nil && !isAPIErrorCode(err, "InvalidPermission.Duplicate") {
+			return groupID, fmt.Errorf("failed to authorize ingress: %w", classifyError(err))
+		}
+	}
+	if len(remove) > 0 {
+		_, err := a.client.RevokeSecurityGroupIngress(ctx, &ec2.RevokeSecurityGroupIngressInput{
+			GroupId:       aws.String(groupID),
+			IpPermissions: ingressPermissions(remove),
+		})
+		if err != nil && !isAPIErrorCode(err, "InvalidPermission.NotFound") {
+			return groupID, fmt.Errorf("failed to revoke ingress: %w", classifyError(err))
+		}
+	}
+	return groupID, nil
+}
+
+// ingressRule is a single TCP port range opened to a CIDR.
+type ingressRule struct {
+	FromPort    int32
+	ToPort      int32
+	CIDR        string
+	Description string
+}
+
+// desiredIngressRules returns the ingress rules of the managed runner
+// security group.
+func desiredIngressRules(cfg config.ManagedSecurityGroup) []ingressRule {
+	var rules []ingressRule
+	for _, cidr := range cfg.SSHCIDRs {
+		rules = append(rules, ingressRule{FromPort: sshPort, ToPort: sshPort, CIDR: cidr, Description: "SSH"})
+	}
+	for _, cidr := range cfg.WinRMCIDRs {
+		rules = append(rules, ingressRule{FromPort: winRMHTTPPort, ToPort: winRMHTTPSPort, CIDR: cidr, Description: "WinRM"})
+	}
+	return rules
+}
+
+// ingressRules flattens the TCP CIDR rules of a security group. Rules
+// referencing other groups or prefix lists are not managed and left out.
+func ingressRules(permissions []types.IpPermission) []ingressRule {
+	var rules []ingressRule
+	for _, permission := range permissions {
+		if aws.ToString(permission.IpProtocol) != "tcp" {
+			continue
+		}
+		from, to := aws.ToInt32(permission.FromPort), aws.ToInt32(permission.ToPort)
+		for _, ipRange := range permission.IpRanges {
+			rules = append(rules, ingressRule{FromPort: from, ToPort: to, CIDR: aws.ToString(ipRange.CidrIp)})
+		}
+		for _, ipRange := range permission.Ipv6Ranges {
+			rules = append(rules, ingressRule{FromPort: from, ToPort: to, CIDR: aws.ToString(ipRange.CidrIpv6)})
+		}
+	}
+	return rules
+}
+
+// diffIngressRules returns the rules to add and the rules to remove to go
+// from the current rules to the desired ones. Descriptions are ignored.
+func diffIngressRules(current, desired []ingressRule) (add, remove []ingressRule) {
+	key := func(rule ingressRule) string {
+		return fmt.Sprintf("%d-%d/%s", rule.FromPort, rule.ToPort, rule.CIDR)
+	}
+	currentKeys := map[string]bool{}
+	for _, rule := range current {
+		currentKeys[key(rule)] = true
+	}
+	desiredKeys := map[string]bool{}
+	for _, rule := range desired {
+		desiredKeys[key(rule)] = true
+		if !currentKeys[key(rule)] {
+			add = append(add, rule)
+		}
+	}
+	for _, rule := range current {
+		if !desiredKeys[key(rule)] {
+			remove = append(remove, rule)
+		}
+	}
+	return add, remove
+}
+
+// ingressPermissions converts ingress rules to security group permissions.
+func ingressPermissions(rules []ingressRule) []types.IpPermission {
+	permissions := make([]types.IpPermission, 0, len(rules))
+	for _, rule := range rules {
+		permission := types.IpPermission{
+			IpProtocol: aws.String("tcp"),
+			FromPort:   aws.Int32(rule.FromPort),
+			ToPort:     aws.Int32(rule.ToPort),
+		}
+		var description *string
+		if rule.Description != "" {
+			description = aws.String(rule.Description)
+		}
+		if strings.Contains(rule.CIDR, ":") {
+			permission.Ipv6Ranges = []types.Ipv6Range{{CidrIpv6: aws.String(rule.CIDR), Description: description}}
+		} else {
+			permission.IpRanges = []types.IpRange{{CidrIp: aws.String(rule.CIDR), Description: description}}
+		}
+		permissions = append(permissions, permission)
+	}
+	return permissions
+}
+
+// securityGroupInUse returns true if any network interface, of a runner or
+// anything else, still uses the security group.
+func (a *AwsCli) securityGroupInUse(ctx context.Context, groupID string) (bool, error) {
+	resp, err := a.client.DescribeNetworkInterfaces(ctx, &ec2.DescribeNetworkInterfacesInput{
+		Filters: []types.Filter{
+			{
+				Name:   aws.String("group-id"),
+				Values: []string{groupID},
+			},
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to list network interfaces of security group %s: %w", groupID, classifyError(err))
+	}
+	return len(resp.NetworkInterfaces) > 0, nil
+}
+
+// collectRunnerSecurityGroups returns the managed runner security groups
+// outside of the given VPCs. Groups in managed VPCs are removed with the VPC.
+func (a *AwsCli) collectRunnerSecurityGroups(ctx context.Context, skipVpcIDs []string) ([]NetworkResource, error) {
+	groups, err := a.findRunnerSecurityGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var resources []NetworkResource
+	for _, group := range groups {
+		vpcID := aws.ToString(group.VpcId)
+		if slices.Contains(skipVpcIDs, vpcID) {
+			continue
+		}
+		resources = append(resources, NetworkResource{
+			Type:  string(types.ResourceTypeSecurityGroup),
+			ID:    aws.ToString(group.GroupId),
+			VpcID: vpcID,
+		})
+	}
+	return resources, nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package client
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/cloudbase/garm-provider-aws/config"
+)
+
+func TestDesiredIngressRules(t *testing.T) {
+	rules := desiredIngressRules(config.ManagedSecurityGroup{
+		Enabled:    true,
+		SSHCIDRs:   []string{"10.0.0.0/8"},
+		WinRMCIDRs: []string{"2001:db8::/32"},
+	})
+	expected := []ingressRule{
+		{FromPort: 22, ToPort: 22, CIDR: "10.0.0.0/8", Description: "SSH"},
+		{FromPort: 5985, ToPort: 5986, CIDR: "2001:db8::/32", Description: "WinRM"},
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, rules)
+	}
+
+	if rules := desiredIngressRules(config.ManagedSecurityGroup{Enabled: true}); len(rules) != 0 {
+		t.Fatalf("expected an egress only group, got %+v", rules)
+	}
+}
+
+func TestIngressPermissionsRoundTrip(t *testing.T) {
+	rules := []ingressRule{
+		{FromPort: 22, ToPort: 22, CIDR: "10.0.0.0/8"},
+		{FromPort: 5985, ToPort: 5986, CIDR: "2001:db8::/32"},
+	}
+	permissions := ingressPermissions(rules)
+	if len(permissions[0].IpRanges) != 1 || len(permissions[1].Ipv6Ranges) != 1 {
+		t.Fatalf("expected IPv4 and IPv6 ranges, got %+v", permissions)
+	}
+	if got := ingressRules(permissions); !reflect.DeepEqual(got, rules) {
+		t.Fatalf("expected %+v, got %+v", rules, got)
+	}
+}
+
+func TestDiffIngressRules(t *testing.T) {
+	current := ingressRules([]types.IpPermission{
+		{
+			IpProtocol: aws.String("tcp"),
+			FromPort:   aws.Int32(22),
+			ToPort:     aws.Int32(22),
+			IpRanges: []types.IpRange{
+				{CidrIp: aws.String("10.0.0.0/8"), Description: aws.String("SSH")},
+				{CidrIp: aws.String("192.168.0.0/16")},
+			},
+		},
+		{
+			// Rules referencing other groups are left alone.
+			IpProtocol:       aws.String("-1"),
+			UserIdGroupPairs: []types.UserIdGroupPair{{GroupId: aws.String("sg-0123456789abcdef0")}},
+		},
+	})
+	desired := desiredIngressRules(config.ManagedSecurityGroup{
+		Enabled:    true,
+		SSHCIDRs:   []string{"10.0.0.0/8"},
+		WinRMCIDRs: []string{"10.0.0.0/8"},
+	})
+
+	add, remove := diffIngressRules(current, desired)
+	if !reflect.DeepEqual(add, []ingressRule{{FromPort: 5985, ToPort: 5986, CIDR: "10.0.0.0/8", Description: "WinRM"}}) {
+		t.Fatalf("unexpected rules to add %+v", add)
+	}
+	if !reflect.DeepEqual(remove, []ingressRule{{FromPort: 22, ToPort: 22, CIDR: "192.168.0.0/16"}}) {
+		t.Fatalf("unexpected rules to remove %+v", remove)
+	}
+
+	if add, remove := diffIngressRules(desired, desired); len(add) != 0 || len(remove) != 0 {
+		t.Fatalf("expected no changes, got %+v %+v", add, remove)
+	}
+}
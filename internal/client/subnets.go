@@ -0,0 +1,273 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/cloudbase/garm-provider-aws/config"
+	"github.com/cloudbase/garm-provider-aws/internal/spec"
+	garmErrors "github.com/cloudbase/garm-provider-common/errors"
+)
+
+// subnetRotationTTL is how long the round-robin position of a pool is kept.
+const subnetRotationTTL = 7 * 24 * time.Hour
+
+// candidateSubnet is a subnet a runner may be launched into.
+type candidateSubnet struct {
+	ID               string
+	AvailabilityZone string
+}
+
+// runInstanceInSubnets launches the runner in the first candidate subnet that
+// has capacity for its flavor.
+func (a *AwsCli) runInstanceInSubnets(ctx context.Context, spec *spec.RunnerSpec) (*types.Instance, error) {
+	subnets, err := a.candidateSubnets(ctx, spec)
+	if err != nil {
+		return nil, err
+	}
+	// The order of the subnets is stable per runner, so this is the subnet
+	// a retried create tried first.
+	first := subnets[0].ID
+	flavor := spec.BootstrapParams.Flavor
+	capacityType := spec.CapacityType()
+	subnets = a.subnetsWithCapacity(subnets, flavor, capacityType)
+	if len(subnets) == 0 {
+		return nil, fmt.Errorf("failed to create instance: %w", capacityCooldownError([]string{flavor}, capacityType))
+	}
+
+	input, err := a.runInstancesInput(ctx, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for idx, subnet := range subnets {
+		attempt := *input
+		attempt.SubnetId = aws.String(subnet.ID)
+		attempt.ClientToken = aws.String(attemptClientToken(aws.ToString(input.ClientToken), first, subnet.ID))
+
+		resp, err := a.client.RunInstances(ctx, &attempt)
+		if err == nil {
+			if len(resp.Instances) == 0 {
+				return nil, fmt.Errorf("no instance returned by RunInstances")
+			}
+			return &resp.Instances[0], nil
+		}
+
+		err = fmt.Errorf("failed to create instance in %s: %w", subnet.ID, classifyError(err))
+		// Errors that may go away on a retry, like a lack of capacity or of
+		// free addresses, are retried in the next subnet. Anything else
+		// would fail in every subnet.
+		if !isRetryable(err) {
+			return nil, err
+		}
+		errs = append(errs, err)
+		if isAPIErrorCode(err, capacityFailureCodes...) {
+			a.recordCapacityFailure(subnet.AvailabilityZone, flavor, capacityType)
+		}
+		if idx < len(subnets)-1 {
+			log.Printf("failed to launch %s in %s (%s), trying the next availability zone", flavor, subnet.AvailabilityZone, ErrorCode(err))
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// candidateSubnets returns the subnets of the runner located in availability
+// zones that offer its flavor, in the order they should be tried.
+func (a *AwsCli) candidateSubnets(ctx context.Context, spec *spec.RunnerSpec) ([]candidateSubnet, error) {
+	subnetIDs := spec.CandidateSubnets()
+	if len(subnetIDs) == 0 {
+		return nil, fmt.Errorf("no subnet configured for runner")
+	}
+
+	// The availability zones are needed even for a single subnet, as
+	// capacity failures are tracked per zone.
+	zones, err := a.subnetAvailabilityZones(ctx, subnetIDs)
+	if err != nil {
+		return nil, err
+	}
+	if len(subnetIDs) == 1 {
+		// Nothing to choose from. Let RunInstances report any problem.
+		return []candidateSubnet{{ID: subnetIDs[0], AvailabilityZone: zones[subnetIDs[0]]}}, nil
+	}
+
+	offered, err := a.availabilityZonesOffering(ctx, spec.BootstrapParams.Flavor)
+	if err != nil {
+		return nil, err
+	}
+
+	var pinnedZone string
+	if spec.Placement != nil {
+		pinnedZone = spec.Placement.AvailabilityZone
+	}
+
+	var subnets []candidateSubnet
+	for _, subnetID := range subnetIDs {
+		zone := zones[subnetID]
+		if !offered[zone] || (pinnedZone != "" && zone != pinnedZone) {
+			continue
+		}
+		subnets = append(subnets, candidateSubnet{ID: subnetID, AvailabilityZone: zone})
+	}
+	if len(subnets) == 0 {
+		return nil, garmErrors.NewBadRequestError("flavor %s is not offered in the availability zones of subnets %s", spec.BootstrapParams.Flavor, strings.Join(subnetIDs, ", "))
+	}
+
+	return a.orderCandidateSubnets(spec, subnets), nil
+}
+
+// orderCandidateSubnets orders the subnets of the runner. The order only
+// depends on the runner and its launch generation, so a retried create
+// tries the subnets in the same order and replays the launch that may have
+// succeeded before.
+func (a *AwsCli) orderCandidateSubnets(spec *spec.RunnerSpec, subnets []candidateSubnet) []candidateSubnet {
+	token := spec.ClientToken()
+	var start int
+	if spec.AZOrder == config.AZOrderRoundRobin {
+		start = a.runnerSubnetRotation(spec.BootstrapParams.PoolID, token)
+	}
+	sum := sha256.Sum256([]byte(token))
+	return orderSubnets(subnets, spec.AZOrder, start, int64(binary.BigEndian.Uint64(sum[:8])))
+}
+
+// orderSubnets returns the subnets in the order they should be tried. For
+// round-robin, start is the position of the first subnet. The random order
+// is derived from seed.
+func orderSubnets(subnets []candidateSubnet, order config.AZOrder, start int, seed int64) []candidateSubnet {
+	ordered := make([]candidateSubnet, 0, len(subnets))
+	switch order {
+	case config.AZOrderPreferredFirst:
+		ordered = append(ordered, subnets...)
+	case config.AZOrderRoundRobin:
+		start %= len(subnets)
+		ordered = append(ordered, subnets[start:]...)
+		ordered = append(ordered, subnets[:start]...)
+	default:
+		ordered = append(ordered, subnets...)
+		rand.New(rand.NewSource(seed)).Shuffle(len(ordered), func(i, j int) {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		})
+	}
+	return ordered
+}
+
+// nextSubnetRotation returns the round-robin position of the pool and
+// advances it. Each launch is a separate process, so the position is kept
+// in the cache dir and advanced under its lock.
+func (a *AwsCli) nextSubnetRotation(poolID string) int {
+	key := a.controllerID + "/" + poolID
+	var position, current int
+	err := a.cache.Update("subnet-rotation", key, &position, subnetRotationTTL, func() error {
+		current = position
+		position++
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to update subnet rotation: %s", err)
+	}
+	return current
+}
+
+// runnerSubnetRotation returns the round-robin position of the runner. It
+// is taken from the pool once per client token, so retries of a create get
+// the same position.
+func (a *AwsCli) runnerSubnetRotation(poolID, token string) int {
+	position := -1
+	err := a.cache.Update("subnet-rotation-runners", a.controllerID+"/"+token, &position, subnetRotationTTL, func() error {
+		if position < 0 {
+			position = a.nextSubnetRotation(poolID)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to update subnet rotation of runner: %s", err)
+	}
+	return max(position, 0)
+}
+
+// subnetAvailabilityZones returns the availability zone of each subnet.
+func (a *AwsCli) subnetAvailabilityZones(ctx context.Context, subnetIDs []string) (map[string]string, error) {
+	zones := map[string]string{}
+	paginator := ec2.NewDescribeSubnetsPaginator(&a.client, &ec2.DescribeSubnetsInput{
+		SubnetIds: subnetIDs,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe subnets: %w", classifyError(err))
+		}
+		for _, subnet := range page.Subnets {
+			zones[aws.ToString(subnet.SubnetId)] = aws.ToString(subnet.AvailabilityZone)
+		}
+	}
+	return zones, nil
+}
+
+// availabilityZonesOffering returns the availability zones of the region that
+// offer the instance type.
+func (a *AwsCli) availabilityZonesOffering(ctx context.Context, instanceType string) (map[string]bool, error) {
+	zones := map[string]bool{}
+	paginator := ec2.NewDescribeInstanceTypeOfferingsPaginator(&a.client, &ec2.DescribeInstanceTypeOfferingsInput{
+		LocationType: types.LocationTypeAvailabilityZone,
+		Filters: []types.Filter{
+			{
+				Name:   aws.String("instance-type"),
+				Values: []string{instanceType},
+			},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe instance type offerings: %w", classifyError(err))
+		}
+		for _, offering := range page.InstanceTypeOfferings {
+			zones[aws.ToString(offering.Location)] = true
+		}
+	}
+	return zones, nil
+}
+
+// attemptClientToken returns the client token of a launch attempt. The first
+// subnet of the runner uses the client token of the runner, so a retried
+// create replays the launch instead of starting another instance. The same
+// client token with different parameters is rejected, so other subnets get
+// a token of their own.
+func attemptClientToken(token, first, subnetID string) string {
+	if subnetID == first {
+		return token
+	}
+	return subnetClientToken(token, subnetID)
+}
+
+// subnetClientToken derives the client token of a launch attempt in another
+// subnet from the client token of the runner.
+func subnetClientToken(token, subnetID string) string {
+	sum := sha256.Sum256([]byte(token + "/" + subnetID))
+	return hex.EncodeToString(sum[:])
+}
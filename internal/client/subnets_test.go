@@ -0,0 +1,141 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package client
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/cloudbase/garm-provider-aws/config"
+	"github.com/cloudbase/garm-provider-aws/internal/cache"
+	"github.com/cloudbase/garm-provider-aws/internal/spec"
+	"github.com/cloudbase/garm-provider-common/params"
+)
+
+func subnetIDs(subnets []candidateSubnet) []string {
+	ids := make([]string, 0, len(subnets))
+	for _, subnet := range subnets {
+		ids = append(ids, subnet.ID)
+	}
+	return ids
+}
+
+func TestOrderSubnets(t *testing.T) {
+	subnets := []candidateSubnet{
+		{ID: "subnet-a", AvailabilityZone: "eu-central-1a"},
+		{ID: "subnet-b", AvailabilityZone: "eu-central-1b"},
+		{ID: "subnet-c", AvailabilityZone: "eu-central-1c"},
+	}
+
+	tests := []struct {
+		name     string
+		order    config.AZOrder
+		start    int
+		expected []string
+	}{
+		{"preferred first", config.AZOrderPreferredFirst, 0, []string{"subnet-a", "subnet-b", "subnet-c"}},
+		{"round robin first launch", config.AZOrderRoundRobin, 0, []string{"subnet-a", "subnet-b", "subnet-c"}},
+		{"round robin second launch", config.AZOrderRoundRobin, 1, []string{"subnet-b", "subnet-c", "subnet-a"}},
+		{"round robin wraps", config.AZOrderRoundRobin, 5, []string{"subnet-c", "subnet-a", "subnet-b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := subnetIDs(orderSubnets(subnets, tt.order, tt.start, 0)); !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+
+	random := subnetIDs(orderSubnets(subnets, config.AZOrderRandom, 0, 42))
+	if again := subnetIDs(orderSubnets(subnets, config.AZOrderRandom, 0, 42)); !reflect.DeepEqual(random, again) {
+		t.Fatalf("random order must only depend on the seed, got %v and %v", random, again)
+	}
+	sort.Strings(random)
+	if !reflect.DeepEqual(random, []string{"subnet-a", "subnet-b", "subnet-c"}) {
+		t.Fatalf("random order must try every subnet once, got %v", random)
+	}
+	if subnets[0].ID != "subnet-a" {
+		t.Fatalf("ordering modified the candidate subnets")
+	}
+}
+
+func TestNextSubnetRotation(t *testing.T) {
+	cli := &AwsCli{
+		controllerID: "controller",
+		cache:        cache.New(t.TempDir()),
+	}
+
+	for expected := 0; expected < 3; expected++ {
+		if position := cli.nextSubnetRotation("pool"); position != expected {
+			t.Fatalf("expected position %d, got %d", expected, position)
+		}
+	}
+	if position := cli.nextSubnetRotation("other-pool"); position != 0 {
+		t.Fatalf("expected pools to rotate independently, got %d", position)
+	}
+}
+
+func TestRetriedCreateReplaysFirstAttempt(t *testing.T) {
+	subnets := []candidateSubnet{
+		{ID: "subnet-a", AvailabilityZone: "eu-central-1a"},
+		{ID: "subnet-b", AvailabilityZone: "eu-central-1b"},
+		{ID: "subnet-c", AvailabilityZone: "eu-central-1c"},
+	}
+
+	for _, order := range []config.AZOrder{config.AZOrderRandom, config.AZOrderRoundRobin, config.AZOrderPreferredFirst} {
+		t.Run(string(order), func(t *testing.T) {
+			cli := &AwsCli{
+				controllerID: "controller",
+				cache:        cache.New(t.TempDir()),
+			}
+			runnerSpec := &spec.RunnerSpec{
+				ControllerID:    "controller",
+				BootstrapParams: params.BootstrapInstance{Name: "garm-runner", PoolID: "pool"},
+				AZOrder:         order,
+			}
+
+			first := cli.orderCandidateSubnets(runnerSpec, subnets)
+			// Another runner of the pool moves the round-robin position.
+			cli.orderCandidateSubnets(&spec.RunnerSpec{
+				ControllerID:    "controller",
+				BootstrapParams: params.BootstrapInstance{Name: "garm-other", PoolID: "pool"},
+				AZOrder:         order,
+			}, subnets)
+			retry := cli.orderCandidateSubnets(runnerSpec, subnets)
+
+			if !reflect.DeepEqual(subnetIDs(first), subnetIDs(retry)) {
+				t.Fatalf("expected the same order for a retry, got %v and %v", subnetIDs(first), subnetIDs(retry))
+			}
+			token := runnerSpec.ClientToken()
+			if got := attemptClientToken(token, retry[0].ID, retry[0].ID); got != token {
+				t.Fatalf("expected the first attempt to use the client token of the runner, got %s", got)
+			}
+			if got := attemptClientToken(token, retry[0].ID, retry[1].ID); got == token {
+				t.Fatalf("expected other subnets to use a token of their own")
+			}
+		})
+	}
+}
+
+func TestSubnetClientToken(t *testing.T) {
+	token := subnetClientToken("token", "subnet-a")
+	if token == subnetClientToken("token", "subnet-b") {
+		t.Fatalf("expected different tokens per subnet")
+	}
+	if len(token) > 64 {
+		t.Fatalf("client token too long: %s", token)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package convert
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/cloudbase/garm-provider-aws/internal/util"
+	garmErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-common/params"
+)
+
+// AwsInstanceToParamsInstance converts an EC2 instance to a GARM provider instance.
+// Terminated instances no longer exist as far as GARM is concerned, so for those
+// an error wrapping ErrNotFound is returned.
+func AwsInstanceToParamsInstance(instance types.Instance) (params.ProviderInstance, error) {
+	if instance.InstanceId == nil {
+		return params.ProviderInstance{}, fmt.Errorf("instance ID is nil")
+	}
+
+	status, err := InstanceStateToStatus(instance.State)
+	if err != nil {
+		return params.ProviderInstance{}, fmt.Errorf("instance %s: %w", *instance.InstanceId, err)
+	}
+
+	details := params.ProviderInstance{
+		ProviderID: *instance.InstanceId,
+		Name:       TagValue(instance.Tags, util.NameTagName),
+		OSType:     instanceOSType(instance),
+		OSArch:     instanceOSArch(instance),
+		Addresses:  instanceAddresses(instance),
+		Status:     status,
+	}
+
+	return details, nil
+}
+
+// InstanceStateToStatus maps an EC2 instance state to a GARM instance status.
+func InstanceStateToStatus(state *types.InstanceState) (params.InstanceStatus, error) {
+	if state == nil {
+		return params.InstanceStatusUnknown, nil
+	}
+
+	switch state.Name {
+	case types.InstanceStateNamePending:
+		return params.InstanceCreating, nil
+	case types.InstanceStateNameRunning:
+		return params.InstanceRunning, nil
+	case types.InstanceStateNameStopping, types.InstanceStateNameStopped:
+		return params.InstanceStopped, nil
+	case types.InstanceStateNameShuttingDown:
+		return params.InstanceDeleting, nil
+	case types.InstanceStateNameTerminated:
+		return params.InstanceStatusUnknown, garmErrors.ErrNotFound
+	default:
+		return params.InstanceStatusUnknown, nil
+	}
+}
+
+// PlatformToOSType maps the EC2 platform of an instance to a GARM OS type. EC2
+// only sets the platform for Windows instances, everything else is Linux.
+func PlatformToOSType(platform types.PlatformValues) params.OSType {
+	if platform == types.PlatformValuesWindows {
+		return params.Windows
+	}
+	return params.Linux
+}
+
+// ArchitectureToOSArch maps an EC2 architecture to a GARM OS architecture.
+func ArchitectureToOSArch(arch types.ArchitectureValues) params.OSArch {
+	switch arch {
+	case types.ArchitectureValuesX8664, types.ArchitectureValuesX8664Mac:
+		return params.Amd64
+	case types.ArchitectureValuesArm64, types.ArchitectureValuesArm64Mac:
+		return params.Arm64
+	case types.ArchitectureValuesI386:
+		return params.I386
+	default:
+		return ""
+	}
+}
+
+// OSArchToArchitecture maps a GARM OS architecture to the EC2 architecture of
+// instance types.
+func OSArchToArchitecture(osArch params.OSArch) types.ArchitectureType {
+	switch osArch {
+	case params.Amd64:
+		return types.ArchitectureTypeX8664
+	case params.Arm64:
+		return types.ArchitectureTypeArm64
+	case params.I386:
+		return types.ArchitectureTypeI386
+	default:
+		return ""
+	}
+}
+
+// TagValue returns the value of the tag with the given key, or an empty string
+// if the tag is not set.
+func TagValue(tags []types.Tag, key string) string {
+	for _, tag := range tags {
+		if tag.Key != nil && *tag.Key == key && tag.Value != nil {
+			return *tag.Value
+		}
+	}
+	return ""
+}
+
+// instanceOSType prefers the OS type recorded in the instance tags at launch
+// and falls back to the platform reported by EC2.
+func instanceOSType(instance types.Instance) params.OSType {
+	if osType := TagValue(instance.Tags, util.OSTypeTagName); osType != "" {
+		return params.OSType(osType)
+	}
+	return PlatformToOSType(instance.Platform)
+}
+
+// instanceOSArch prefers the OS architecture recorded in the instance tags at
+// launch and falls back to the architecture reported by EC2.
+func instanceOSArch(instance types.Instance) params.OSArch {
+	if osArch := TagValue(instance.Tags, util.OSArchTagName); osArch != "" {
+		return params.OSArch(osArch)
+	}
+	return ArchitectureToOSArch(instance.Architecture)
+}
+
+func instanceAddresses(instance types.Instance) []params.Address {
+	var addresses []params.Address
+	seen := map[string]bool{}
+	add := func(addr *string, addrType params.AddressType) {
+		if addr == nil || *addr == "" || seen[*addr] {
+			return
+		}
+		seen[*addr] = true
+		addresses = append(addresses, params.Address{
+			Address: *addr,
+			Type:    addrType,
+		})
+	}
+
+	add(instance.PrivateIpAddress, params.PrivateAddress)
+	add(instance.PublicIpAddress, params.PublicAddress)
+	// IPv6 addresses assigned to instances are globally routable.
+	add(instance.Ipv6Address, params.PublicAddress)
+	for _, iface := range instance.NetworkInterfaces {
+		for _, ipv6 := range iface.Ipv6Addresses {
+			add(ipv6.Ipv6Address, params.PublicAddress)
+		}
+	}
+
+	return addresses
+}
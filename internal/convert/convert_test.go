@@ -0,0 +1,239 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package convert
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	garmErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-common/params"
+)
+
+func TestInstanceStateToStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		state    *types.InstanceState
+		expected params.InstanceStatus
+		notFound bool
+	}{
+		{
+			name:     "nil state",
+			state:    nil,
+			expected: params.InstanceStatusUnknown,
+		},
+		{
+			name:     "pending",
+			state:    &types.InstanceState{Name: types.InstanceStateNamePending},
+			expected: params.InstanceCreating,
+		},
+		{
+			name:     "running",
+			state:    &types.InstanceState{Name: types.InstanceStateNameRunning},
+			expected: params.InstanceRunning,
+		},
+		{
+			name:     "stopping",
+			state:    &types.InstanceState{Name: types.InstanceStateNameStopping},
+			expected: params.InstanceStopped,
+		},
+		{
+			name:     "stopped",
+			state:    &types.InstanceState{Name: types.InstanceStateNameStopped},
+			expected: params.InstanceStopped,
+		},
+		{
+			name:     "shutting-down",
+			state:    &types.InstanceState{Name: types.InstanceStateNameShuttingDown},
+			expected: params.InstanceDeleting,
+		},
+		{
+			name:     "terminated",
+			state:    &types.InstanceState{Name: types.InstanceStateNameTerminated},
+			expected: params.InstanceStatusUnknown,
+			notFound: true,
+		},
+		{
+			name:     "unknown state",
+			state:    &types.InstanceState{Name: types.InstanceStateName("bogus")},
+			expected: params.InstanceStatusUnknown,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, err := InstanceStateToStatus(tt.state)
+			if tt.notFound {
+				if !errors.Is(err, garmErrors.ErrNotFound) {
+					t.Fatalf("expected not found error, got %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if status != tt.expected {
+				t.Fatalf("expected status %q, got %q", tt.expected, status)
+			}
+		})
+	}
+}
+
+func TestPlatformAndArchitecture(t *testing.T) {
+	tests := []struct {
+		name         string
+		platform     types.PlatformValues
+		arch         types.ArchitectureValues
+		expectedOS   params.OSType
+		expectedArch params.OSArch
+	}{
+		{"linux x86_64", "", types.ArchitectureValuesX8664, params.Linux, params.Amd64},
+		{"linux arm64", "", types.ArchitectureValuesArm64, params.Linux, params.Arm64},
+		{"linux i386", "", types.ArchitectureValuesI386, params.Linux, params.I386},
+		{"linux x86_64_mac", "", types.ArchitectureValuesX8664Mac, params.Linux, params.Amd64},
+		{"linux arm64_mac", "", types.ArchitectureValuesArm64Mac, params.Linux, params.Arm64},
+		{"windows x86_64", types.PlatformValuesWindows, types.ArchitectureValuesX8664, params.Windows, params.Amd64},
+		{"windows arm64", types.PlatformValuesWindows, types.ArchitectureValuesArm64, params.Windows, params.Arm64},
+		{"windows i386", types.PlatformValuesWindows, types.ArchitectureValuesI386, params.Windows, params.I386},
+		{"unknown architecture", "", types.ArchitectureValues("bogus"), params.Linux, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if osType := PlatformToOSType(tt.platform); osType != tt.expectedOS {
+				t.Fatalf("expected OS type %q, got %q", tt.expectedOS, osType)
+			}
+			if osArch := ArchitectureToOSArch(tt.arch); osArch != tt.expectedArch {
+				t.Fatalf("expected OS arch %q, got %q", tt.expectedArch, osArch)
+			}
+		})
+	}
+}
+
+func TestAwsInstanceToParamsInstance(t *testing.T) {
+	tests := []struct {
+		name     string
+		instance types.Instance
+		expected params.ProviderInstance
+		errIs    error
+		wantErr  bool
+	}{
+		{
+			name: "running linux instance with all addresses",
+			instance: types.Instance{
+				InstanceId:   aws.String("i-1234567890abcdef0"),
+				Architecture: types.ArchitectureValuesX8664,
+				State:        &types.InstanceState{Name: types.InstanceStateNameRunning},
+				Tags: []types.Tag{
+					{Key: aws.String("garm-pool-id"), Value: aws.String("pool")},
+					{Key: aws.String("Name"), Value: aws.String("garm-runner")},
+				},
+				PrivateIpAddress: aws.String("10.0.0.10"),
+				PublicIpAddress:  aws.String("203.0.113.10"),
+				Ipv6Address:      aws.String("2001:db8::10"),
+				NetworkInterfaces: []types.InstanceNetworkInterface{
+					{
+						Ipv6Addresses: []types.InstanceIpv6Address{
+							{Ipv6Address: aws.String("2001:db8::10")},
+							{Ipv6Address: aws.String("2001:db8::11")},
+						},
+					},
+				},
+			},
+			expected: params.ProviderInstance{
+				ProviderID: "i-1234567890abcdef0",
+				Name:       "garm-runner",
+				OSType:     params.Linux,
+				OSArch:     params.Amd64,
+				Status:     params.InstanceRunning,
+				Addresses: []params.Address{
+					{Address: "10.0.0.10", Type: params.PrivateAddress},
+					{Address: "203.0.113.10", Type: params.PublicAddress},
+					{Address: "2001:db8::10", Type: params.PublicAddress},
+					{Address: "2001:db8::11", Type: params.PublicAddress},
+				},
+			},
+		},
+		{
+			name: "pending windows arm64 instance without addresses",
+			instance: types.Instance{
+				InstanceId:   aws.String("i-0abcdef"),
+				Architecture: types.ArchitectureValuesArm64,
+				Platform:     types.PlatformValuesWindows,
+				State:        &types.InstanceState{Name: types.InstanceStateNamePending},
+			},
+			expected: params.ProviderInstance{
+				ProviderID: "i-0abcdef",
+				OSType:     params.Windows,
+				OSArch:     params.Arm64,
+				Status:     params.InstanceCreating,
+			},
+		},
+		{
+			name: "os type and arch tags take precedence",
+			instance: types.Instance{
+				InstanceId:   aws.String("i-0abcdef"),
+				Architecture: types.ArchitectureValuesX8664,
+				State:        &types.InstanceState{Name: types.InstanceStateNameStopped},
+				Tags: []types.Tag{
+					{Key: aws.String("garm-os-type"), Value: aws.String("windows")},
+					{Key: aws.String("garm-os-arch"), Value: aws.String("arm64")},
+				},
+			},
+			expected: params.ProviderInstance{
+				ProviderID: "i-0abcdef",
+				OSType:     params.Windows,
+				OSArch:     params.Arm64,
+				Status:     params.InstanceStopped,
+			},
+		},
+		{
+			name: "terminated instance",
+			instance: types.Instance{
+				InstanceId: aws.String("i-0abcdef"),
+				State:      &types.InstanceState{Name: types.InstanceStateNameTerminated},
+			},
+			errIs:   garmErrors.ErrNotFound,
+			wantErr: true,
+		},
+		{
+			name:     "missing instance ID",
+			instance: types.Instance{},
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			details, err := AwsInstanceToParamsInstance(tt.instance)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				}
+				if tt.errIs != nil && !errors.Is(err, tt.errIs) {
+					t.Fatalf("expected error %v, got %v", tt.errIs, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(details, tt.expected) {
+				t.Fatalf("expected %+v, got %+v", tt.expected, details)
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package spec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cloudbase/garm-provider-aws/config"
+	awsUtil "github.com/cloudbase/garm-provider-aws/internal/util"
+	garmErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-common/params"
+)
+
+// reservedTagPref is the tag key prefix reserved for AWS use.
+const reservedTagPref = "aws:"
+
+func newExtraSpecsFromBootstrapData(data params.BootstrapInstance) (*extraSpecs, error) {
+	spec := &extraSpecs{}
+
+	// Pools without extra specs may send null, which is not an object.
+	specsJSON := bytes.TrimSpace(data.ExtraSpecs)
+	if len(specsJSON) > 0 && !bytes.Equal(specsJSON, []byte("null")) {
+		var raw interface{}
+		if err := json.Unmarshal(specsJSON, &raw); err != nil {
+			return nil, garmErrors.NewBadRequestError("failed to decode extra specs: %s", err)
+		}
+		if err := ExtraSpecsSchema().Validate(raw); err != nil {
+			return nil, garmErrors.NewBadRequestError("invalid extra specs: %s", err)
+		}
+
+		decoder := json.NewDecoder(bytes.NewReader(specsJSON))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(spec); err != nil {
+			return nil, garmErrors.NewBadRequestError("failed to decode extra specs: %s", err)
+		}
+	}
+
+	if err := spec.Validate(); err != nil {
+		return nil, garmErrors.NewBadRequestError("invalid extra specs: %s", err)
+	}
+
+	return spec, nil
+}
+
+// extraSpecs holds the pool level settings that can be passed in through
+// the extra specs of a garm pool. The description and jsonschema tags are
+// used to generate the extra specs JSON schema, which both documents the
+// extra specs and validates them.
+type extraSpecs struct {
+	MinCount             int32                 `description:"Deprecated. Each runner is a single instance, so only 1 is accepted." jsonschema:"minimum=0;maximum=1"`
+	MaxCount             int32                 `description:"Deprecated. Each runner is a single instance, so only 1 is accepted." jsonschema:"minimum=0;maximum=1"`
+	SubnetID             string                `json:"subnet_id,omitempty" description:"Subnet runners of the pool are launched into." jsonschema:"pattern=^subnet-[0-9a-f]{8,17}$"`
+	SubnetIDs            []string              `json:"subnet_ids,omitempty" description:"Candidate subnets of the pool. Runners are launched into the first one with capacity." jsonschema:"pattern=^subnet-[0-9a-f]{8,17}$"`
+	AZOrder              string                `json:"az_order,omitempty" description:"Order in which the candidate subnets are tried." jsonschema:"enum=random|round-robin|preferred-first"`
+	SecurityGroupIDs     []string              `json:"security_group_ids,omitempty" description:"Security groups attached to runners. Replaces the security groups from the provider config." jsonschema:"pattern=^sg-[0-9a-f]{8,17}$"`
+	SecurityGroupNames   []string              `json:"security_group_names,omitempty" description:"Security groups attached to runners, by name. Replaces the security groups from the provider config." jsonschema:"minLength=1;maxLength=255"`
+	Hibernate            *bool                 `json:"hibernate,omitempty" description:"Launch runners with hibernation enabled and hibernate them on stop."`
+	IAMInstanceProfile   string                `json:"iam_instance_profile,omitempty" description:"Name or ARN of the IAM instance profile."`
+	KeyName              string                `json:"key_name,omitempty" description:"Name of the EC2 key pair injected into runners."`
+	RootVolume           *config.EBSVolume     `json:"root_volume,omitempty" description:"Root EBS volume of runners. Fields set here override the provider config."`
+	DataVolumes          []config.EBSVolume    `json:"data_volumes,omitempty" description:"Additional EBS volumes attached to runners. Replaces the data volumes from the provider config."`
+	Tags                 map[string]string     `json:"tags,omitempty" description:"Additional tags applied to runners, their volumes and network interfaces." jsonschema:"maxProperties=44;keyMinLength=1;keyMaxLength=128;maxLength=256"`
+	Placement            *Placement            `json:"placement,omitempty" description:"Where runners are placed."`
+	Tenancy              string                `json:"tenancy,omitempty" description:"Tenancy of runners." jsonschema:"enum=default|dedicated|host"`
+	CreditSpecification  string                `json:"credit_specification,omitempty" description:"CPU credit option of burstable instances." jsonschema:"enum=standard|unlimited"`
+	MetadataOptions      *MetadataOptions      `json:"metadata_options,omitempty" description:"Instance metadata service settings."`
+	SpotOptions          *SpotOptions          `json:"spot_options,omitempty" description:"Launch runners on spot capacity."`
+	InstanceTypes        []InstanceType        `json:"instance_types,omitempty" description:"Candidate instance types. When set, runners are launched with an EC2 Fleet instead of the pool flavor."`
+	AllocationStrategy   string                `json:"allocation_strategy,omitempty" description:"How the fleet picks among the candidate instance types. The capacity optimized strategies require spot_options. Defaults to price-capacity-optimized for spot and lowest-price for on-demand." jsonschema:"enum=lowest-price|capacity-optimized|price-capacity-optimized"`
+	InstanceRequirements *InstanceRequirements `json:"instance_requirements,omitempty" description:"Launch any instance type matching these attributes instead of the pool flavor."`
+
+	// The fields below are read by cloudconfig.GetSpecs from the same extra
+	// specs when the userdata is generated. They are declared here so the
+	// schema and the strict decoding accept them.
+	RunnerInstallTemplate []byte            `json:"runner_install_template,omitempty" description:"Base64 encoded template replacing the runner install script."`
+	PreInstallScripts     map[string][]byte `json:"pre_install_scripts,omitempty" description:"Base64 encoded scripts run as root before the runner is installed, in alphabetical order of their names. Linux only."`
+	ExtraContext          map[string]string `json:"extra_context,omitempty" description:"Extra values passed to the runner install template."`
+}
+
+// InstanceRequirements selects instance types by their attributes. The
+// architecture is taken from the pool.
+type InstanceRequirements struct {
+	VCPUCount             *Range   `json:"vcpu_count,omitempty" description:"Number of vCPUs."`
+	MemoryMiB             *Range   `json:"memory_mib,omitempty" description:"Amount of memory in MiB."`
+	AllowBurstable        bool     `json:"allow_burstable,omitempty" description:"Include burstable performance (T) instance types."`
+	ExcludedInstanceTypes []string `json:"excluded_instance_types,omitempty" description:"Instance types or families to exclude. Accepts wildcards, eg: m4.*, c5d.*" jsonschema:"pattern=^[a-z0-9*][a-z0-9.*-]*$"`
+	MaxPrice              string   `json:"max_price,omitempty" description:"Maximum hourly price of a runner." jsonschema:"pattern=^([0-9]+\\.?[0-9]*|\\.[0-9]+)$"`
+}
+
+// Range is an inclusive range. A zero max means no upper limit.
+type Range struct {
+	Min int32 `json:"min" description:"Lower limit." jsonschema:"minimum=0"`
+	Max int32 `json:"max,omitempty" description:"Upper limit." jsonschema:"minimum=0"`
+}
+
+// Validate checks the limits of the range.
+func (r *Range) Validate() error {
+	if r.Max > 0 && r.Max < r.Min {
+		return fmt.Errorf("max: must not be lower than min")
+	}
+	return nil
+}
+
+// Validate checks the requirements that cannot be expressed in the schema.
+func (r *InstanceRequirements) Validate() error {
+	if r.VCPUCount == nil {
+		return fmt.Errorf("vcpu_count: missing vCPU count")
+	}
+	if err := r.VCPUCount.Validate(); err != nil {
+		return fmt.Errorf("vcpu_count.%w", err)
+	}
+	if r.MemoryMiB == nil {
+		return fmt.Errorf("memory_mib: missing memory")
+	}
+	if err := r.MemoryMiB.Validate(); err != nil {
+		return fmt.Errorf("memory_mib.%w", err)
+	}
+	if r.MaxPrice != "" {
+		if price, err := strconv.ParseFloat(r.MaxPrice, 64); err != nil || price <= 0 {
+			return fmt.Errorf("max_price: must be a positive number")
+		}
+	}
+	return nil
+}
+
+// InstanceType is a candidate instance type of a fleet launch.
+type InstanceType struct {
+	InstanceType string  `json:"instance_type" description:"EC2 instance type, eg: m7i.large." jsonschema:"pattern=^[a-z0-9-]+\\.[a-z0-9-]+$"`
+	Weight       float64 `json:"weight,omitempty" description:"Capacity units the instance type counts for. Higher weights are preferred when comparing price per unit." jsonschema:"minimum=1"`
+}
+
+// Placement configures where runners are placed.
+type Placement struct {
+	AvailabilityZone string `json:"availability_zone,omitempty" description:"Availability zone runners are pinned to."`
+	GroupName        string `json:"group_name,omitempty" description:"Name of a placement group."`
+	HostID           string `json:"host_id,omitempty" description:"Dedicated host to launch on. Requires host tenancy."`
+}
+
+// MetadataOptions configures the instance metadata service of runners.
+type MetadataOptions struct {
+	HTTPTokens              string `json:"http_tokens,omitempty" description:"Set to required to enforce IMDSv2." jsonschema:"enum=optional|required"`
+	HTTPPutResponseHopLimit int32  `json:"http_put_response_hop_limit,omitempty" description:"Hop limit of metadata responses." jsonschema:"minimum=1;maximum=64"`
+	HTTPEndpoint            string `json:"http_endpoint,omitempty" description:"Enable or disable the metadata endpoint." jsonschema:"enum=enabled|disabled"`
+	InstanceMetadataTags    string `json:"instance_metadata_tags,omitempty" description:"Expose instance tags in the metadata." jsonschema:"enum=enabled|disabled"`
+}
+
+// SpotOptions configures spot capacity for runners.
+type SpotOptions struct {
+	MaxPrice             string `json:"max_price,omitempty" description:"Maximum hourly price. Defaults to the on-demand price." jsonschema:"pattern=^([0-9]+\\.?[0-9]*|\\.[0-9]+)$"`
+	InterruptionBehavior string `json:"interruption_behavior,omitempty" description:"What happens to runners when spot capacity is reclaimed." jsonschema:"enum=terminate|stop|hibernate"`
+	FallbackToOnDemand   bool   `json:"fallback_to_on_demand,omitempty" description:"Launch an on-demand runner when no spot capacity is available at the max price."`
+}
+
+// Validate checks the constraints of the extra specs that span several
+// fields and cannot be expressed in the JSON schema. Errors name the
+// offending field.
+func (e *extraSpecs) Validate() error {
+	if err := validateTags(e.Tags); err != nil {
+		return fmt.Errorf("tags: %w", err)
+	}
+	if e.Placement != nil && e.Placement.HostID != "" && e.Tenancy != "host" {
+		return fmt.Errorf("placement.host_id: requires host tenancy")
+	}
+	if e.SubnetID != "" && len(e.SubnetIDs) > 0 {
+		return fmt.Errorf("subnet_ids: cannot be used together with subnet_id")
+	}
+	for idx, name := range e.SecurityGroupNames {
+		if strings.HasPrefix(name, "sg-") {
+			return fmt.Errorf("security_group_names[%d]: security group names cannot start with sg-, use security_group_ids", idx)
+		}
+	}
+	for idx, instanceType := range e.InstanceTypes {
+		if instanceType.InstanceType == "" {
+			return fmt.Errorf("instance_types[%d].instance_type: missing instance type", idx)
+		}
+	}
+	if e.InstanceRequirements != nil {
+		if len(e.InstanceTypes) > 0 {
+			return fmt.Errorf("instance_requirements: cannot be used together with instance_types")
+		}
+		if err := e.InstanceRequirements.Validate(); err != nil {
+			return fmt.Errorf("instance_requirements.%w", err)
+		}
+	}
+	usesFleet := len(e.InstanceTypes) > 0 || e.InstanceRequirements != nil
+	if e.AllocationStrategy != "" && !usesFleet {
+		return fmt.Errorf("allocation_strategy: requires instance_types or instance_requirements")
+	}
+	if e.AllocationStrategy != "" && e.AllocationStrategy != "lowest-price" && e.SpotOptions == nil {
+		return fmt.Errorf("allocation_strategy: %s requires spot_options, on-demand capacity only supports lowest-price", e.AllocationStrategy)
+	}
+	if usesFleet && e.SpotOptions != nil && e.SpotOptions.InterruptionBehavior != "" && e.SpotOptions.InterruptionBehavior != "terminate" {
+		// Fleets in instant mode only place one-time spot requests.
+		return fmt.Errorf("spot_options.interruption_behavior: only terminate is supported with instance_types and instance_requirements")
+	}
+	if e.SpotOptions != nil && e.SpotOptions.MaxPrice != "" {
+		if price, err := strconv.ParseFloat(e.SpotOptions.MaxPrice, 64); err != nil || price <= 0 {
+			return fmt.Errorf("spot_options.max_price: must be a positive number")
+		}
+	}
+	return nil
+}
+
+func validateTags(tags map[string]string) error {
+	reserved := []string{
+		awsUtil.NameTagName,
+		awsUtil.ControllerIDTagName,
+		awsUtil.PoolIDTagName,
+		awsUtil.OSTypeTagName,
+		awsUtil.OSArchTagName,
+		awsUtil.CapacityTypeTagName,
+	}
+	for key := range tags {
+		if strings.HasPrefix(strings.ToLower(key), reservedTagPref) {
+			return fmt.Errorf("key %q uses the reserved %s prefix", key, reservedTagPref)
+		}
+		if oneOf(key, reserved) {
+			return fmt.Errorf("key %q is managed by garm", key)
+		}
+	}
+	return nil
+}
+
+func oneOf(value string, allowed []string) bool {
+	for _, a := range allowed {
+		if value == a {
+			return true
+		}
+	}
+	return false
+}
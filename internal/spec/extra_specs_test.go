@@ -0,0 +1,237 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package spec
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	garmErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-common/params"
+)
+
+func TestNewExtraSpecsFromBootstrapData(t *testing.T) {
+	tests := []struct {
+		name       string
+		extraSpecs string
+		// errField is a substring the error must contain. Empty means success.
+		errField string
+	}{
+		{
+			name:       "empty",
+			extraSpecs: ``,
+		},
+		{
+			name:       "null",
+			extraSpecs: `null`,
+		},
+		{
+			name:       "whitespace",
+			extraSpecs: " \n\t",
+		},
+		{
+			name: "full",
+			extraSpecs: `{
+				"subnet_id": "subnet-0123456789abcdef0",
+				"security_group_ids": ["sg-0123456789abcdef0"],
+				"iam_instance_profile": "garm-runner",
+				"key_name": "garm",
+				"root_volume": {"size_gb": 100, "volume_type": "gp3", "iops": 4000, "throughput": 250, "encrypted": true, "kms_key_id": "alias/garm", "delete_on_termination": true},
+				"data_volumes": [
+					{"device_name": "/dev/sdf", "size_gb": 200, "volume_type": "io2", "iops": 10000},
+					{"device_name": "/dev/sdg", "snapshot_tags": {"cache": "docker"}, "mount_path": "/var/lib/docker"}
+				],
+				"tags": {"team": "ci"},
+				"placement": {"availability_zone": "eu-central-1a"},
+				"tenancy": "default",
+				"credit_specification": "unlimited",
+				"metadata_options": {"http_tokens": "required", "http_put_response_hop_limit": 2},
+				"spot_options": {"max_price": "0.05", "interruption_behavior": "terminate"},
+				"instance_types": [{"instance_type": "m7i.large", "weight": 2}, {"instance_type": "m6i.large"}],
+				"allocation_strategy": "price-capacity-optimized"
+			}`,
+		},
+		{
+			name:       "unknown field",
+			extraSpecs: `{"subnet": "subnet-0123456789abcdef0"}`,
+			errField:   "subnet: unknown field",
+		},
+		{
+			name:       "single instance count",
+			extraSpecs: `{"MinCount": 1, "MaxCount": 1}`,
+		},
+		{
+			name:       "several instances",
+			extraSpecs: `{"MaxCount": 2}`,
+			errField:   "MaxCount",
+		},
+		{
+			name:       "on-demand capacity optimized",
+			extraSpecs: `{"instance_types": [{"instance_type": "m7i.large"}], "allocation_strategy": "capacity-optimized"}`,
+			errField:   "allocation_strategy",
+		},
+		{
+			name:       "invalid subnet",
+			extraSpecs: `{"subnet_id": "vpc-0123456789abcdef0"}`,
+			errField:   "subnet_id",
+		},
+		{
+			name:       "invalid security group",
+			extraSpecs: `{"security_group_ids": ["sg-0123456789abcdef0", "default"]}`,
+			errField:   "security_group_ids[1]",
+		},
+		{
+			name:       "cloud config specs",
+			extraSpecs: `{"pre_install_scripts": {"10-prep.sh": "IyEvYmluL2Jhc2g="}, "runner_install_template": "IyEvYmluL2Jhc2g=", "extra_context": {"proxy": "http://proxy:3128"}}`,
+		},
+		{
+			name:       "invalid pre install script",
+			extraSpecs: `{"pre_install_scripts": {"10-prep.sh": ["#!/bin/bash"]}}`,
+			errField:   "pre_install_scripts.10-prep.sh",
+		},
+		{
+			name:       "security group names",
+			extraSpecs: `{"security_group_ids": ["sg-0123456789abcdef0"], "security_group_names": ["runners"]}`,
+		},
+		{
+			name:       "security group id as name",
+			extraSpecs: `{"security_group_names": ["runners", "sg-0123456789abcdef0"]}`,
+			errField:   "security_group_names[1]",
+		},
+		{
+			name:       "empty security group name",
+			extraSpecs: `{"security_group_names": [""]}`,
+			errField:   "security_group_names[0]",
+		},
+		{
+			name:       "invalid data volume device",
+			extraSpecs: `{"data_volumes": [{"device_name": "/dev/sda1", "size_gb": 100}]}`,
+			errField:   "data_volumes[0].device_name",
+		},
+		{
+			name:       "invalid mount path",
+			extraSpecs: `{"data_volumes": [{"device_name": "/dev/sdf", "snapshot_id": "snap-0123456789abcdef0", "mount_path": "docker"}]}`,
+			errField:   "data_volumes[0].mount_path",
+		},
+		{
+			name:       "missing instance type",
+			extraSpecs: `{"instance_types": [{"weight": 2}]}`,
+			errField:   "instance_types[0].instance_type",
+		},
+		{
+			name:       "fractional weight",
+			extraSpecs: `{"instance_types": [{"instance_type": "m7i.large", "weight": 0.5}]}`,
+			errField:   "instance_types[0].weight",
+		},
+		{
+			name:       "allocation strategy without instance types",
+			extraSpecs: `{"allocation_strategy": "lowest-price"}`,
+			errField:   "allocation_strategy",
+		},
+		{
+			name:       "fleet with stop on interruption",
+			extraSpecs: `{"instance_types": [{"instance_type": "m7i.large"}], "spot_options": {"interruption_behavior": "stop"}}`,
+			errField:   "spot_options.interruption_behavior",
+		},
+		{
+			name:       "instance requirements",
+			extraSpecs: `{"instance_requirements": {"vcpu_count": {"min": 2, "max": 8}, "memory_mib": {"min": 4096}, "excluded_instance_types": ["t2.*", "m4.*"], "max_price": "0.2"}, "allocation_strategy": "lowest-price"}`,
+		},
+		{
+			name:       "instance requirements without memory",
+			extraSpecs: `{"instance_requirements": {"vcpu_count": {"min": 2}}}`,
+			errField:   "instance_requirements.memory_mib",
+		},
+		{
+			name:       "instance requirements with inverted range",
+			extraSpecs: `{"instance_requirements": {"vcpu_count": {"min": 8, "max": 2}, "memory_mib": {"min": 4096}}}`,
+			errField:   "instance_requirements.vcpu_count.max",
+		},
+		{
+			name:       "instance requirements with instance types",
+			extraSpecs: `{"instance_types": [{"instance_type": "m7i.large"}], "instance_requirements": {"vcpu_count": {"min": 2}, "memory_mib": {"min": 4096}}}`,
+			errField:   "instance_requirements",
+		},
+		{
+			name:       "subnet ids",
+			extraSpecs: `{"subnet_ids": ["subnet-0123456789abcdef0", "subnet-0fedcba9876543210"], "az_order": "round-robin"}`,
+		},
+		{
+			name:       "subnet ids with subnet id",
+			extraSpecs: `{"subnet_id": "subnet-0123456789abcdef0", "subnet_ids": ["subnet-0fedcba9876543210"]}`,
+			errField:   "subnet_ids",
+		},
+		{
+			name:       "invalid az order",
+			extraSpecs: `{"az_order": "nearest"}`,
+			errField:   "az_order",
+		},
+		{
+			name:       "reserved tag",
+			extraSpecs: `{"tags": {"garm-pool-id": "other"}}`,
+			errField:   "tags",
+		},
+		{
+			name:       "invalid tenancy",
+			extraSpecs: `{"tenancy": "shared"}`,
+			errField:   "tenancy",
+		},
+		{
+			name:       "invalid hop limit",
+			extraSpecs: `{"metadata_options": {"http_put_response_hop_limit": 100}}`,
+			errField:   "metadata_options.http_put_response_hop_limit",
+		},
+		{
+			name:       "wrong type",
+			extraSpecs: `{"root_volume": {"size_gb": "100"}}`,
+			errField:   "root_volume.size_gb: must be a number",
+		},
+		{
+			name:       "tag value too long",
+			extraSpecs: `{"tags": {"team": "` + strings.Repeat("a", 257) + `"}}`,
+			errField:   "tags.team",
+		},
+		{
+			name:       "invalid spot price",
+			extraSpecs: `{"spot_options": {"max_price": "cheap"}}`,
+			errField:   "spot_options.max_price",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newExtraSpecsFromBootstrapData(params.BootstrapInstance{
+				ExtraSpecs: []byte(tt.extraSpecs),
+			})
+			if tt.errField == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected error mentioning %s, got nil", tt.errField)
+			}
+			if !strings.Contains(err.Error(), tt.errField) {
+				t.Fatalf("expected error mentioning %s, got %v", tt.errField, err)
+			}
+			var badRequest *garmErrors.BadRequestError
+			if !errors.As(err, &badRequest) {
+				t.Fatalf("expected bad request error, got %T", err)
+			}
+		})
+	}
+}
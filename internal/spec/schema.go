@@ -0,0 +1,313 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package spec
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const jsonSchemaDraft = "https://json-schema.org/draft/2020-12/schema"
+
+// Schema is the subset of JSON Schema needed to describe and validate the
+// extra specs.
+type Schema struct {
+	Schema               string             `json:"$schema,omitempty"`
+	Title                string             `json:"title,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties interface{}        `json:"additionalProperties,omitempty"`
+	PropertyNames        *Schema            `json:"propertyNames,omitempty"`
+	MaxProperties        *int               `json:"maxProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	ContentEncoding      string             `json:"contentEncoding,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+var (
+	extraSpecsSchema     *Schema
+	extraSpecsSchemaOnce sync.Once
+)
+
+// ExtraSpecsSchema returns the JSON schema of the pool extra specs, generated
+// from the extra specs struct.
+func ExtraSpecsSchema() *Schema {
+	extraSpecsSchemaOnce.Do(func() {
+		extraSpecsSchema = schemaForType(reflect.TypeOf(extraSpecs{}), "")
+		extraSpecsSchema.Schema = jsonSchemaDraft
+		extraSpecsSchema.Title = "garm-provider-aws extra specs"
+	})
+	return extraSpecsSchema
+}
+
+// schemaForType generates the schema of a Go type. Constraints are read from
+// the jsonschema struct tag, as a semicolon separated list of key=value pairs.
+func schemaForType(t reflect.Type, constraints string) *Schema {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	s := &Schema{}
+	opts := parseConstraints(constraints)
+	switch t.Kind() {
+	case reflect.String:
+		s.Type = "string"
+		s.applyStringConstraints(opts)
+	case reflect.Bool:
+		s.Type = "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		s.Type = "integer"
+		s.applyNumberConstraints(opts)
+	case reflect.Float32, reflect.Float64:
+		s.Type = "number"
+		s.applyNumberConstraints(opts)
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// encoding/json encodes byte slices as base64 strings.
+			s.Type = "string"
+			s.ContentEncoding = "base64"
+			break
+		}
+		s.Type = "array"
+		s.Items = schemaForType(t.Elem(), constraints)
+	case reflect.Map:
+		s.Type = "object"
+		if v, ok := opts["maxProperties"]; ok {
+			s.MaxProperties = intPtr(v)
+		}
+		keys := &Schema{Type: "string"}
+		if v, ok := opts["keyMinLength"]; ok {
+			keys.MinLength = intPtr(v)
+		}
+		if v, ok := opts["keyMaxLength"]; ok {
+			keys.MaxLength = intPtr(v)
+		}
+		s.PropertyNames = keys
+		s.AdditionalProperties = schemaForType(t.Elem(), constraints)
+	case reflect.Struct:
+		s.Type = "object"
+		s.AdditionalProperties = false
+		s.Properties = map[string]*Schema{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := jsonFieldName(field)
+			if name == "" {
+				continue
+			}
+			prop := schemaForType(field.Type, field.Tag.Get("jsonschema"))
+			prop.Description = field.Tag.Get("description")
+			s.Properties[name] = prop
+		}
+	}
+	return s
+}
+
+func (s *Schema) applyStringConstraints(opts map[string]string) {
+	if v, ok := opts["enum"]; ok {
+		s.Enum = strings.Split(v, "|")
+	}
+	if v, ok := opts["pattern"]; ok {
+		s.Pattern = v
+		s.pattern = regexp.MustCompile(v)
+	}
+	if v, ok := opts["minLength"]; ok {
+		s.MinLength = intPtr(v)
+	}
+	if v, ok := opts["maxLength"]; ok {
+		s.MaxLength = intPtr(v)
+	}
+}
+
+func (s *Schema) applyNumberConstraints(opts map[string]string) {
+	if v, ok := opts["minimum"]; ok {
+		s.Minimum = floatPtr(v)
+	}
+	if v, ok := opts["maximum"]; ok {
+		s.Maximum = floatPtr(v)
+	}
+}
+
+func parseConstraints(tag string) map[string]string {
+	opts := map[string]string{}
+	if tag == "" {
+		return opts
+	}
+	for _, opt := range strings.Split(tag, ";") {
+		key, value, _ := strings.Cut(opt, "=")
+		opts[key] = value
+	}
+	return opts
+}
+
+func jsonFieldName(field reflect.StructField) string {
+	if !field.IsExported() {
+		return ""
+	}
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return ""
+	}
+	name, _, _ := strings.Cut(tag, ",")
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+func intPtr(v string) *int {
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		panic(fmt.Sprintf("invalid integer constraint %q", v))
+	}
+	return &i
+}
+
+func floatPtr(v string) *float64 {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		panic(fmt.Sprintf("invalid number constraint %q", v))
+	}
+	return &f
+}
+
+// Validate validates a decoded JSON document against the schema. The returned
+// error names the path of the offending field.
+func (s *Schema) Validate(value interface{}) error {
+	return s.validate(value, "")
+}
+
+func (s *Schema) validate(value interface{}, path string) error {
+	field := path
+	if field == "" {
+		field = "extra specs"
+	}
+
+	switch s.Type {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: must be an object", field)
+		}
+		return s.validateObject(obj, path)
+	case "array":
+		arr, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: must be an array", field)
+		}
+		for idx, item := range arr {
+			if err := s.Items.validate(item, fmt.Sprintf("%s[%d]", path, idx)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s: must be a string", field)
+		}
+		return s.validateString(str, field)
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: must be a boolean", field)
+		}
+	case "integer", "number":
+		num, ok := value.(float64)
+		if !ok {
+			return fmt.Errorf("%s: must be a number", field)
+		}
+		if s.Type == "integer" && num != math.Trunc(num) {
+			return fmt.Errorf("%s: must be an integer", field)
+		}
+		if s.Minimum != nil && num < *s.Minimum {
+			return fmt.Errorf("%s: must be at least %v", field, *s.Minimum)
+		}
+		if s.Maximum != nil && num > *s.Maximum {
+			return fmt.Errorf("%s: must be at most %v", field, *s.Maximum)
+		}
+	}
+	return nil
+}
+
+func (s *Schema) validateObject(obj map[string]interface{}, path string) error {
+	if s.MaxProperties != nil && len(obj) > *s.MaxProperties {
+		return fmt.Errorf("%s: must have at most %d entries", path, *s.MaxProperties)
+	}
+
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		keyPath := key
+		if path != "" {
+			keyPath = path + "." + key
+		}
+
+		if prop, ok := s.Properties[key]; ok {
+			if err := prop.validate(obj[key], keyPath); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch additional := s.AdditionalProperties.(type) {
+		case *Schema:
+			if s.PropertyNames != nil {
+				if err := s.PropertyNames.validateString(key, keyPath); err != nil {
+					return err
+				}
+			}
+			if err := additional.validate(obj[key], keyPath); err != nil {
+				return err
+			}
+		case bool:
+			if !additional {
+				return fmt.Errorf("%s: unknown field", keyPath)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Schema) validateString(str, field string) error {
+	if len(s.Enum) > 0 && !oneOf(str, s.Enum) {
+		return fmt.Errorf("%s: must be one of %s", field, strings.Join(s.Enum, ", "))
+	}
+	if s.pattern != nil && !s.pattern.MatchString(str) {
+		return fmt.Errorf("%s: must match %s", field, s.Pattern)
+	}
+	if s.MinLength != nil && len(str) < *s.MinLength {
+		return fmt.Errorf("%s: must be at least %d characters", field, *s.MinLength)
+	}
+	if s.MaxLength != nil && len(str) > *s.MaxLength {
+		return fmt.Errorf("%s: must be at most %d characters", field, *s.MaxLength)
+	}
+	return nil
+}
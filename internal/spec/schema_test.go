@@ -0,0 +1,61 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package spec
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestExtraSpecsSchemaDocumentsEveryField(t *testing.T) {
+	var check func(path string, s *Schema)
+	check = func(path string, s *Schema) {
+		for name, prop := range s.Properties {
+			propPath := path + "." + name
+			if prop.Description == "" {
+				t.Errorf("%s has no description", propPath)
+			}
+			check(propPath, prop)
+		}
+	}
+	check("extra_specs", ExtraSpecsSchema())
+}
+
+func TestExtraSpecsSchemaMarshal(t *testing.T) {
+	data, err := json.Marshal(ExtraSpecsSchema())
+	if err != nil {
+		t.Fatalf("failed to marshal schema: %v", err)
+	}
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("failed to unmarshal schema: %v", err)
+	}
+	if decoded["additionalProperties"] != false {
+		t.Fatalf("expected additionalProperties to be false, got %v", decoded["additionalProperties"])
+	}
+
+	props, ok := decoded["properties"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected properties in schema")
+	}
+	tenancy, ok := props["tenancy"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected tenancy property in schema")
+	}
+	if enum, ok := tenancy["enum"].([]interface{}); !ok || len(enum) != 3 {
+		t.Fatalf("expected tenancy enum with 3 values, got %v", tenancy["enum"])
+	}
+}
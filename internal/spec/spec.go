@@ -15,38 +15,22 @@
 package spec
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
-	"encoding/json"
+	"encoding/hex"
 	"fmt"
+	"sort"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/cloudbase/garm-provider-aws/config"
+	awsUtil "github.com/cloudbase/garm-provider-aws/internal/util"
 	"github.com/cloudbase/garm-provider-common/cloudconfig"
+	garmErrors "github.com/cloudbase/garm-provider-common/errors"
 	"github.com/cloudbase/garm-provider-common/params"
 	"github.com/cloudbase/garm-provider-common/util"
 )
 
-func newExtraSpecsFromBootstrapData(data params.BootstrapInstance) (*extraSpecs, error) {
-	spec := &extraSpecs{}
-
-	if len(data.ExtraSpecs) > 0 {
-		if err := json.Unmarshal(data.ExtraSpecs, spec); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal extra specs: %w", err)
-		}
-	}
-	spec.ensureValidExtraSpec()
-
-	return spec, nil
-}
-
-type extraSpecs struct {
-	MinCount int32
-	MaxCount int32
-}
-
-func (e *extraSpecs) ensureValidExtraSpec() {
-
-}
-
 func GetRunnerSpecFromBootstrapParams(cfg config.Config, data params.BootstrapInstance, controllerID string) (*RunnerSpec, error) {
 	tools, err := util.GetTools(data.OSType, data.OSArch, data.Tools)
 	if err != nil {
@@ -59,26 +43,69 @@ func GetRunnerSpecFromBootstrapParams(cfg config.Config, data params.BootstrapIn
 	}
 
 	spec := &RunnerSpec{
-		Region:          cfg.Region,
-		Tools:           tools,
-		BootstrapParams: data,
-		MinCount:        1,
-		MaxCount:        1,
+		Region:             cfg.Region,
+		ControllerID:       controllerID,
+		Tools:              tools,
+		BootstrapParams:    data,
+		MinCount:           1,
+		MaxCount:           1,
+		SubnetIDs:          cfg.SubnetIDs,
+		AZOrder:            cfg.AZOrder,
+		SecurityGroupIDs:   cfg.SecurityGroupIDs,
+		SecurityGroupNames: cfg.SecurityGroupNames,
+		Hibernate:          cfg.Hibernate,
+		RootVolume:         cfg.RootVolume,
+		DataVolumes:        cfg.DataVolumes,
 	}
 
 	spec.MergeExtraSpecs(extraSpecs)
-	spec.SetUserData()
+	if err := spec.ValidateVolumes(); err != nil {
+		return nil, garmErrors.NewBadRequestError("invalid volumes: %s", err)
+	}
+	if err := spec.SetUserData(); err != nil {
+		return nil, garmErrors.NewBadRequestError("invalid userdata: %s", err)
+	}
 
 	return spec, nil
 }
 
 type RunnerSpec struct {
 	Region          string
+	ControllerID    string
 	Tools           params.RunnerApplicationDownload
 	BootstrapParams params.BootstrapInstance
 	UserData        string
 	MinCount        int32
 	MaxCount        int32
+	// SubnetID is only set when the runner is pinned to a single subnet.
+	SubnetID string
+	// SubnetIDs are the candidate subnets of the runner. Fleet launches
+	// span all of them.
+	SubnetIDs []string
+	// AZOrder is the order in which SubnetIDs are tried.
+	AZOrder          config.AZOrder
+	SecurityGroupIDs []string
+	// SecurityGroupNames are resolved to IDs in the VPC of the runner
+	// before launching.
+	SecurityGroupNames []string
+	Hibernate          bool
+
+	IAMInstanceProfile   string
+	KeyName              string
+	RootVolume           config.EBSVolume
+	DataVolumes          []config.EBSVolume
+	ExtraTags            map[string]string
+	Placement            *Placement
+	Tenancy              string
+	CreditSpecification  string
+	MetadataOptions      *MetadataOptions
+	SpotOptions          *SpotOptions
+	InstanceTypes        []InstanceType
+	AllocationStrategy   string
+	InstanceRequirements *InstanceRequirements
+	// LaunchGeneration counts the instances of this runner the provider
+	// terminated. It is part of the client token.
+	LaunchGeneration int
 }
 
 func (r *RunnerSpec) Validate() error {
@@ -88,16 +115,207 @@ func (r *RunnerSpec) Validate() error {
 	if r.BootstrapParams.Name == "" {
 		return fmt.Errorf("missing bootstrap params")
 	}
+	if r.ControllerID == "" {
+		return fmt.Errorf("missing controller ID")
+	}
 	return nil
 }
 
 func (r *RunnerSpec) MergeExtraSpecs(extraSpecs *extraSpecs) {
-	if extraSpecs.MinCount > 1 {
-		r.MinCount = extraSpecs.MinCount
+	if extraSpecs.SubnetID != "" {
+		r.SetSubnet(extraSpecs.SubnetID)
+	}
+	if len(extraSpecs.SubnetIDs) > 0 {
+		r.SubnetIDs = extraSpecs.SubnetIDs
+	}
+	if extraSpecs.AZOrder != "" {
+		r.AZOrder = config.AZOrder(extraSpecs.AZOrder)
+	}
+	if len(extraSpecs.SecurityGroupIDs) > 0 || len(extraSpecs.SecurityGroupNames) > 0 {
+		r.SecurityGroupIDs = extraSpecs.SecurityGroupIDs
+		r.SecurityGroupNames = extraSpecs.SecurityGroupNames
+	}
+	if extraSpecs.Hibernate != nil {
+		r.Hibernate = *extraSpecs.Hibernate
+	}
+	if extraSpecs.IAMInstanceProfile != "" {
+		r.IAMInstanceProfile = extraSpecs.IAMInstanceProfile
+	}
+	if extraSpecs.KeyName != "" {
+		r.KeyName = extraSpecs.KeyName
+	}
+	if extraSpecs.RootVolume != nil {
+		r.RootVolume = r.RootVolume.Merge(*extraSpecs.RootVolume)
+	}
+	if len(extraSpecs.DataVolumes) > 0 {
+		r.DataVolumes = extraSpecs.DataVolumes
+	}
+	if len(extraSpecs.Tags) > 0 {
+		r.ExtraTags = extraSpecs.Tags
+	}
+	if extraSpecs.Placement != nil {
+		r.Placement = extraSpecs.Placement
+	}
+	if extraSpecs.Tenancy != "" {
+		r.Tenancy = extraSpecs.Tenancy
+	}
+	if extraSpecs.CreditSpecification != "" {
+		r.CreditSpecification = extraSpecs.CreditSpecification
+	}
+	if extraSpecs.MetadataOptions != nil {
+		r.MetadataOptions = extraSpecs.MetadataOptions
+	}
+	if extraSpecs.SpotOptions != nil {
+		r.SpotOptions = extraSpecs.SpotOptions
+	}
+	if len(extraSpecs.InstanceTypes) > 0 {
+		r.InstanceTypes = extraSpecs.InstanceTypes
+	}
+	if extraSpecs.InstanceRequirements != nil {
+		r.InstanceRequirements = extraSpecs.InstanceRequirements
+	}
+	r.AllocationStrategy = extraSpecs.AllocationStrategy
+}
+
+// SetSubnet pins the runner to a single subnet.
+func (r *RunnerSpec) SetSubnet(subnetID string) {
+	r.SubnetID = subnetID
+	r.SubnetIDs = []string{subnetID}
+}
+
+// CandidateSubnets returns the subnets the runner may be launched into.
+func (r *RunnerSpec) CandidateSubnets() []string {
+	if len(r.SubnetIDs) > 0 {
+		return r.SubnetIDs
+	}
+	if r.SubnetID != "" {
+		return []string{r.SubnetID}
+	}
+	return nil
+}
+
+// Flavors returns the instance types the runner may be launched as.
+func (r *RunnerSpec) Flavors() []string {
+	if len(r.InstanceTypes) == 0 {
+		return []string{r.BootstrapParams.Flavor}
+	}
+	flavors := make([]string, 0, len(r.InstanceTypes))
+	for _, instanceType := range r.InstanceTypes {
+		flavors = append(flavors, instanceType.InstanceType)
+	}
+	return flavors
+}
+
+// ValidateVolumes checks the merged root and data volumes against the EBS
+// limits, so misconfigurations fail before anything is launched.
+func (r *RunnerSpec) ValidateVolumes() error {
+	if err := r.RootVolume.ValidateRoot(); err != nil {
+		return fmt.Errorf("root_volume.%w", err)
+	}
+	if err := config.ValidateDataVolumes(r.DataVolumes); err != nil {
+		return err
 	}
-	if extraSpecs.MaxCount > 1 {
-		r.MaxCount = extraSpecs.MaxCount
+	if len(r.mountedVolumes()) > 0 && r.BootstrapParams.OSType != params.Linux {
+		return fmt.Errorf("data_volumes: mount_path is only supported on Linux runners")
 	}
+	return nil
+}
+
+// Tags returns the tags applied to every resource created for this runner.
+func (r *RunnerSpec) Tags() []types.Tag {
+	tags := []types.Tag{
+		{
+			Key:   aws.String(awsUtil.NameTagName),
+			Value: aws.String(r.BootstrapParams.Name),
+		},
+		{
+			Key:   aws.String(awsUtil.ControllerIDTagName),
+			Value: aws.String(r.ControllerID),
+		},
+		{
+			Key:   aws.String(awsUtil.PoolIDTagName),
+			Value: aws.String(r.BootstrapParams.PoolID),
+		},
+		{
+			Key:   aws.String(awsUtil.OSTypeTagName),
+			Value: aws.String(string(r.BootstrapParams.OSType)),
+		},
+		{
+			Key:   aws.String(awsUtil.OSArchTagName),
+			Value: aws.String(string(r.BootstrapParams.OSArch)),
+		},
+		{
+			Key:   aws.String(awsUtil.CapacityTypeTagName),
+			Value: aws.String(r.CapacityType()),
+		},
+	}
+
+	keys := make([]string, 0, len(r.ExtraTags))
+	for key := range r.ExtraTags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		tags = append(tags, types.Tag{
+			Key:   aws.String(key),
+			Value: aws.String(r.ExtraTags[key]),
+		})
+	}
+	return tags
+}
+
+// CapacityType returns the capacity type the runner is launched with.
+func (r *RunnerSpec) CapacityType() string {
+	if r.SpotOptions != nil {
+		return awsUtil.CapacityTypeSpot
+	}
+	return awsUtil.CapacityTypeOnDemand
+}
+
+// OnDemand returns a copy of the spec that launches on on-demand capacity.
+func (r *RunnerSpec) OnDemand() *RunnerSpec {
+	onDemand := *r
+	onDemand.SpotOptions = nil
+	return &onDemand
+}
+
+// ClientToken returns the idempotency token used when launching the runner.
+// It is derived from the controller ID and runner name, so a retried create
+// for the same runner never launches a second instance. The launch
+// generation changes the token once the provider terminated an instance of
+// the runner, so the runner can be created again. Spot launches use a
+// different token, so falling back to on-demand is not rejected as a
+// mismatching retry.
+func (r *RunnerSpec) ClientToken() string {
+	token := r.ControllerID + "/" + r.BootstrapParams.Name
+	if r.LaunchGeneration > 0 {
+		token += fmt.Sprintf("/%d", r.LaunchGeneration)
+	}
+	if r.SpotOptions != nil {
+		token += "/" + awsUtil.CapacityTypeSpot
+	}
+	sum := sha256.Sum256([]byte(token))
+	// Client tokens are limited to 64 ASCII characters.
+	return hex.EncodeToString(sum[:])
+}
+
+// TagSpecifications returns the tag specifications used to tag the instance,
+// its volumes and its network interfaces at launch.
+func (r *RunnerSpec) TagSpecifications() []types.TagSpecification {
+	resourceTypes := []types.ResourceType{
+		types.ResourceTypeInstance,
+		types.ResourceTypeVolume,
+		types.ResourceTypeNetworkInterface,
+	}
+
+	tagSpecs := make([]types.TagSpecification, 0, len(resourceTypes))
+	for _, resourceType := range resourceTypes {
+		tagSpecs = append(tagSpecs, types.TagSpecification{
+			ResourceType: resourceType,
+			Tags:         r.Tags(),
+		})
+	}
+	return tagSpecs
 }
 
 func (r *RunnerSpec) SetUserData() error {
@@ -116,6 +334,10 @@ func (r *RunnerSpec) SetUserData() error {
 }
 
 func (r *RunnerSpec) ComposeUserData() ([]byte, error) {
+	if volumes := r.mountedVolumes(); len(volumes) > 0 && r.BootstrapParams.OSType == params.Linux {
+		return r.composeLinuxUserDataWithMounts(volumes)
+	}
+
 	switch r.BootstrapParams.OSType {
 	case params.Linux, params.Windows:
 		udata, err := cloudconfig.GetCloudConfig(r.BootstrapParams, r.Tools, r.BootstrapParams.Name)
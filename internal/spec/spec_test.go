@@ -0,0 +1,109 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package spec
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/cloudbase/garm-provider-aws/config"
+	awsUtil "github.com/cloudbase/garm-provider-aws/internal/util"
+	garmErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-common/params"
+)
+
+func capacityTypeTag(t *testing.T, spec *RunnerSpec) string {
+	t.Helper()
+	for _, tag := range spec.Tags() {
+		if aws.ToString(tag.Key) == awsUtil.CapacityTypeTagName {
+			return aws.ToString(tag.Value)
+		}
+	}
+	t.Fatalf("missing %s tag", awsUtil.CapacityTypeTagName)
+	return ""
+}
+
+func TestSpotFallbackToOnDemand(t *testing.T) {
+	spot := testRunnerSpec(params.Linux)
+	spot.ControllerID = "controller"
+	spot.SpotOptions = &SpotOptions{MaxPrice: "0.05", FallbackToOnDemand: true}
+
+	onDemand := spot.OnDemand()
+	if spot.SpotOptions == nil {
+		t.Fatalf("OnDemand modified the original spec")
+	}
+	if onDemand.SpotOptions != nil {
+		t.Fatalf("expected no spot options, got %+v", onDemand.SpotOptions)
+	}
+
+	if tag := capacityTypeTag(t, spot); tag != awsUtil.CapacityTypeSpot {
+		t.Fatalf("expected spot capacity type tag, got %s", tag)
+	}
+	if tag := capacityTypeTag(t, onDemand); tag != awsUtil.CapacityTypeOnDemand {
+		t.Fatalf("expected on-demand capacity type tag, got %s", tag)
+	}
+	if spot.ClientToken() == onDemand.ClientToken() {
+		t.Fatalf("spot and on-demand launches must use different client tokens")
+	}
+	if len(onDemand.ClientToken()) > 64 {
+		t.Fatalf("client token too long: %s", onDemand.ClientToken())
+	}
+}
+
+func TestClientTokenChangesWithLaunchGeneration(t *testing.T) {
+	spec := testRunnerSpec(params.Linux)
+	spec.ControllerID = "controller"
+
+	first := spec.ClientToken()
+	if again := spec.ClientToken(); again != first {
+		t.Fatalf("client token must be stable for retries, got %s and %s", first, again)
+	}
+	spec.LaunchGeneration = 1
+	if spec.ClientToken() == first {
+		t.Fatalf("client token must change once the runner was terminated")
+	}
+}
+
+func TestGetRunnerSpecRejectsBrokenUserData(t *testing.T) {
+	osName, arch := "linux", "x64"
+	filename := "actions-runner-linux-x64-2.310.2.tar.gz"
+	downloadURL := "https://example.com/" + filename
+	data := params.BootstrapInstance{
+		Name:   "garm-runner",
+		OSType: params.Linux,
+		OSArch: params.Amd64,
+		Tools: []params.RunnerApplicationDownload{
+			{OS: &osName, Architecture: &arch, Filename: &filename, DownloadURL: &downloadURL},
+		},
+		// "e3sgLkJyb2tlbg==" is "{{ .Broken", an unterminated install template.
+		ExtraSpecs: []byte(`{"runner_install_template": "e3sgLkJyb2tlbg=="}`),
+	}
+
+	_, err := GetRunnerSpecFromBootstrapParams(config.Config{}, data, "controller")
+	var badRequest *garmErrors.BadRequestError
+	if !errors.As(err, &badRequest) {
+		t.Fatalf("expected bad request, got %v", err)
+	}
+
+	data.ExtraSpecs = nil
+	spec, err := GetRunnerSpecFromBootstrapParams(config.Config{}, data, "controller")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if spec.UserData == "" {
+		t.Fatalf("expected userdata")
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package spec
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"text/template"
+
+	"github.com/cloudbase/garm-provider-aws/config"
+	"github.com/cloudbase/garm-provider-common/cloudconfig"
+	"github.com/cloudbase/garm-provider-common/defaults"
+)
+
+const mountVolumesScriptPath = "/garm-mount-volumes.sh"
+
+// mountVolumesScript mounts data volumes before the runner is installed. On
+// Nitro instances EBS volumes show up as NVMe devices, whose requested device
+// name is stored in the vendor specific controller data.
+var mountVolumesScript = template.Must(template.New("mount").Parse(`#!/bin/bash
+set -e
+
+find_device() {
+	local device="$1"
+	local suffix="${device#/dev/}"
+	suffix="${suffix#sd}"
+	suffix="${suffix#xvd}"
+
+	for candidate in "/dev/sd${suffix}" "/dev/xvd${suffix}"; do
+		if [ -b "$candidate" ]; then
+			echo "$candidate"
+			return 0
+		fi
+	done
+
+	for nvme in /dev/nvme*n1; do
+		[ -b "$nvme" ] || continue
+		local name
+		# The controller data is binary. Read the 32 byte device name at
+		# offset 3072 by position, not by line.
+		name=$(nvme id-ctrl --raw-binary "$nvme" 2>/dev/null | dd bs=1 skip=3072 count=32 2>/dev/null | tr -d ' \0')
+		name="${name#/dev/}"
+		if [ "$name" = "sd${suffix}" ] || [ "$name" = "xvd${suffix}" ]; then
+			echo "$nvme"
+			return 0
+		fi
+	done
+	return 1
+}
+
+mount_volume() {
+	local device="$1"
+	local path="$2"
+	local found=""
+
+	for i in $(seq 1 60); do
+		if found=$(find_device "$device"); then
+			break
+		fi
+		sleep 2
+	done
+	if [ -z "$found" ]; then
+		echo "data volume $device not found" >&2
+		return 1
+	fi
+
+	if ! blkid "$found" >/dev/null 2>&1; then
+		mkfs.ext4 -q "$found"
+	fi
+	mkdir -p "$path"
+	mount "$found" "$path"
+	echo "UUID=$(blkid -s UUID -o value "$found") $path auto defaults,nofail 0 2" >> /etc/fstab
+}
+{{ range . }}
+mount_volume {{ .DeviceName }} {{ .MountPath }}
+{{- end }}
+`))
+
+// mountedVolumes returns the data volumes the userdata needs to mount.
+func (r *RunnerSpec) mountedVolumes() []config.EBSVolume {
+	var volumes []config.EBSVolume
+	for _, volume := range r.DataVolumes {
+		if volume.MountPath != "" {
+			volumes = append(volumes, volume)
+		}
+	}
+	return volumes
+}
+
+// composeLinuxUserDataWithMounts builds the same cloud-config as
+// cloudconfig.GetCloudInitConfig, with the data volumes mounted before the
+// pre-install scripts run and the runner is installed.
+func (r *RunnerSpec) composeLinuxUserDataWithMounts(volumes []config.EBSVolume) ([]byte, error) {
+	cloudSpecs, err := cloudconfig.GetSpecs(r.BootstrapParams)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cloud config specs: %w", err)
+	}
+
+	var mountScript bytes.Buffer
+	if err := mountVolumesScript.Execute(&mountScript, volumes); err != nil {
+		return nil, fmt.Errorf("failed to generate mount script: %w", err)
+	}
+
+	installScript, err := cloudconfig.GetRunnerInstallScript(r.BootstrapParams, r.Tools, r.BootstrapParams.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate install script: %w", err)
+	}
+
+	cloudCfg := cloudconfig.NewDefaultCloudInitConfig()
+	if r.BootstrapParams.UserDataOptions.DisableUpdatesOnBoot {
+		cloudCfg.PackageUpgrade = false
+		cloudCfg.Packages = []string{}
+	}
+	cloudCfg.AddPackage(r.BootstrapParams.UserDataOptions.ExtraPackages...)
+	cloudCfg.AddPackage("nvme-cli")
+
+	cloudCfg.AddFile(mountScript.Bytes(), mountVolumesScriptPath, "root:root", "755")
+	cloudCfg.AddRunCmd(mountVolumesScriptPath)
+	cloudCfg.AddRunCmd(fmt.Sprintf("rm -f %s", mountVolumesScriptPath))
+
+	names := make([]string, 0, len(cloudSpecs.PreInstallScripts))
+	for name := range cloudSpecs.PreInstallScripts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		scriptPath := fmt.Sprintf("/garm-pre-install/%s", name)
+		cloudCfg.AddFile(cloudSpecs.PreInstallScripts[name], scriptPath, "root:root", "755")
+		cloudCfg.AddRunCmd(scriptPath)
+	}
+	cloudCfg.AddRunCmd("rm -rf /garm-pre-install")
+
+	cloudCfg.AddSSHKey(r.BootstrapParams.SSHKeys...)
+	cloudCfg.AddFile(installScript, "/install_runner.sh", "root:root", "755")
+	cloudCfg.AddRunCmd(fmt.Sprintf("su -l -c /install_runner.sh %s", defaults.DefaultUser))
+	cloudCfg.AddRunCmd("rm -f /install_runner.sh")
+	if len(r.BootstrapParams.CACertBundle) > 0 {
+		if err := cloudCfg.AddCACert(r.BootstrapParams.CACertBundle); err != nil {
+			return nil, fmt.Errorf("failed to add CA cert bundle: %w", err)
+		}
+	}
+
+	udata, err := cloudCfg.Serialize()
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize cloud config: %w", err)
+	}
+	return []byte(udata), nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package spec
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cloudbase/garm-provider-aws/config"
+	"github.com/cloudbase/garm-provider-common/params"
+)
+
+func testRunnerSpec(osType params.OSType, volumes ...config.EBSVolume) *RunnerSpec {
+	filename := "actions-runner-linux-x64-2.310.2.tar.gz"
+	downloadURL := "https://example.com/" + filename
+	return &RunnerSpec{
+		Tools: params.RunnerApplicationDownload{
+			Filename:    &filename,
+			DownloadURL: &downloadURL,
+		},
+		BootstrapParams: params.BootstrapInstance{
+			Name:   "garm-runner",
+			OSType: osType,
+			OSArch: params.Amd64,
+		},
+		DataVolumes: volumes,
+	}
+}
+
+func TestComposeUserDataMountsDataVolumes(t *testing.T) {
+	spec := testRunnerSpec(params.Linux,
+		config.EBSVolume{DeviceName: "/dev/sdf", SnapshotID: "snap-0123456789abcdef0", MountPath: "/var/lib/docker"},
+		config.EBSVolume{DeviceName: "/dev/sdg", SizeGB: 100},
+	)
+
+	udata, err := spec.ComposeUserData()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cloudConfig := string(udata)
+	for _, expected := range []string{"#cloud-config", "nvme-cli", mountVolumesScriptPath, "/install_runner.sh"} {
+		if !strings.Contains(cloudConfig, expected) {
+			t.Fatalf("expected userdata to contain %q:\n%s", expected, cloudConfig)
+		}
+	}
+	if strings.Index(cloudConfig, "- "+mountVolumesScriptPath) > strings.Index(cloudConfig, "su -l -c /install_runner.sh") {
+		t.Fatalf("data volumes must be mounted before the runner is installed:\n%s", cloudConfig)
+	}
+
+	var script strings.Builder
+	if err := mountVolumesScript.Execute(&script, spec.mountedVolumes()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(script.String(), "mount_volume /dev/sdf /var/lib/docker") {
+		t.Fatalf("expected mount of /dev/sdf:\n%s", script.String())
+	}
+	if strings.Contains(script.String(), "mount_volume /dev/sdg") {
+		t.Fatalf("unexpected mount of /dev/sdg:\n%s", script.String())
+	}
+}
+
+func TestComposeUserDataMountsRunsPreInstallScripts(t *testing.T) {
+	spec := testRunnerSpec(params.Linux, config.EBSVolume{DeviceName: "/dev/sdf", SizeGB: 100, MountPath: "/cache"})
+	// "IyEvYmluL2Jhc2g=" is "#!/bin/bash".
+	spec.BootstrapParams.ExtraSpecs = []byte(`{"pre_install_scripts": {"10-prep.sh": "IyEvYmluL2Jhc2g="}}`)
+
+	udata, err := spec.ComposeUserData()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cloudConfig := string(udata)
+	preInstall := strings.Index(cloudConfig, "- /garm-pre-install/10-prep.sh")
+	if preInstall < 0 {
+		t.Fatalf("expected userdata to run the pre-install script:\n%s", cloudConfig)
+	}
+	if preInstall < strings.Index(cloudConfig, "- "+mountVolumesScriptPath) || preInstall > strings.Index(cloudConfig, "su -l -c /install_runner.sh") {
+		t.Fatalf("pre-install scripts must run after the mounts and before the runner is installed:\n%s", cloudConfig)
+	}
+}
+
+func TestComposeUserDataWithoutMounts(t *testing.T) {
+	spec := testRunnerSpec(params.Linux, config.EBSVolume{DeviceName: "/dev/sdf", SizeGB: 100})
+
+	udata, err := spec.ComposeUserData()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(string(udata), mountVolumesScriptPath) {
+		t.Fatalf("unexpected mount script in userdata:\n%s", udata)
+	}
+}
+
+func TestValidateVolumesRejectsWindowsMounts(t *testing.T) {
+	spec := testRunnerSpec(params.Windows, config.EBSVolume{DeviceName: "xvdf", SizeGB: 100, MountPath: "/data"})
+
+	err := spec.ValidateVolumes()
+	if err == nil || !strings.Contains(err.Error(), "mount_path") {
+		t.Fatalf("expected mount_path error, got %v", err)
+	}
+}
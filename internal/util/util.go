@@ -17,4 +17,13 @@ package util
 const (
 	ControllerIDTagName = "garm-controller-id"
 	PoolIDTagName       = "garm-pool-id"
+	NameTagName         = "Name"
+	OSTypeTagName       = "garm-os-type"
+	OSArchTagName       = "garm-os-arch"
+	CapacityTypeTagName = "garm-capacity-type"
+)
+
+const (
+	CapacityTypeOnDemand = "on-demand"
+	CapacityTypeSpot     = "spot"
 )
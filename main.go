@@ -38,12 +38,20 @@ func main() {
 
 	util.SetupLogging()
 
+	if len(os.Args) > 1 {
+		if err := runCommand(ctx, os.Args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%+v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	executionEnv, err := execution.GetEnvironment()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	prov, err := provider.NewAwsProvider(executionEnv.ProviderConfigFile, executionEnv.ControllerID)
+	prov, err := provider.NewAwsProvider(ctx, executionEnv.ProviderConfigFile, executionEnv.ControllerID)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -51,7 +59,7 @@ func main() {
 	result, err := execution.Run(ctx, prov, executionEnv)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "failed to run command: %+v\n", err)
-		os.Exit(1)
+		os.Exit(execution.ResolveErrorToExitCode(err))
 	}
 	if len(result) > 0 {
 		fmt.Fprint(os.Stdout, result)
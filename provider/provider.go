@@ -16,28 +16,35 @@ package provider
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/cloudbase/garm-provider-aws/config"
 	"github.com/cloudbase/garm-provider-aws/internal/client"
+	"github.com/cloudbase/garm-provider-aws/internal/convert"
 	"github.com/cloudbase/garm-provider-aws/internal/spec"
+	garmErrors "github.com/cloudbase/garm-provider-common/errors"
 	"github.com/cloudbase/garm-provider-common/execution"
 	"github.com/cloudbase/garm-provider-common/params"
 )
 
 var _ execution.ExternalProvider = &AwsProvider{}
 
-func NewAwsProvider(configPath, controllerID string) (execution.ExternalProvider, error) {
+func NewAwsProvider(ctx context.Context, configPath, controllerID string) (*AwsProvider, error) {
 	conf, err := config.NewConfig(configPath)
 	if err != nil {
 		return nil, fmt.Errorf("error loading config: %w", err)
 	}
-	awsCli, err := client.NewAwsCli(conf)
+	awsCli, err := client.NewAwsCli(ctx, conf, controllerID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get AWS CLI: %w", err)
 	}
 
 	return &AwsProvider{
+		cfg:          conf,
 		controllerID: controllerID,
 		awsCli:       awsCli,
 	}, nil
@@ -49,9 +56,11 @@ type AwsProvider struct {
 	awsCli       *client.AwsCli
 }
 
-func (a *AwsProvider) CreateInstance(ctx context.Context, bootstrapParams params.BootstrapInstance) (params.ProviderInstance, error) {
-	if bootstrapParams.OSArch != params.Amd64 {
-		return params.ProviderInstance{}, fmt.Errorf("unsupported architecture: %s", bootstrapParams.OSArch)
+func (a *AwsProvider) CreateInstance(ctx context.Context, bootstrapParams params.BootstrapInstance) (instance params.ProviderInstance, err error) {
+	switch bootstrapParams.OSArch {
+	case params.Amd64, params.Arm64:
+	default:
+		return params.ProviderInstance{}, garmErrors.NewBadRequestError("unsupported architecture: %s", bootstrapParams.OSArch)
 	}
 
 	spec, err := spec.GetRunnerSpecFromBootstrapParams(*a.cfg, bootstrapParams, a.controllerID)
@@ -59,63 +68,158 @@ func (a *AwsProvider) CreateInstance(ctx context.Context, bootstrapParams params
 		return params.ProviderInstance{}, fmt.Errorf("failed to get runner spec: %w", err)
 	}
 
-	igwID, err := a.awsCli.CreateInternetGateway(ctx)
+	// GARM retries creates that timed out. Return the instance launched by
+	// an earlier attempt instead of launching a new one.
+	existing, err := a.awsCli.FindInstanceByName(ctx, spec.BootstrapParams.Name)
 	if err != nil {
-		return params.ProviderInstance{}, fmt.Errorf("failed to get internet gateway: %w", err)
+		return params.ProviderInstance{}, fmt.Errorf("failed to look up existing instance: %w", err)
+	}
+	if existing != nil {
+		instance, err := convert.AwsInstanceToParamsInstance(*existing)
+		if err != nil {
+			return params.ProviderInstance{}, fmt.Errorf("failed to convert VM details: %w", err)
+		}
+		return instance, nil
 	}
 
-	vpcID, err := a.awsCli.CreateVpc(ctx, "10.10.0.0/16")
-	if err != nil {
-		return params.ProviderInstance{}, fmt.Errorf("failed to get VPC: %w", err)
+	flavors := spec.Flavors()
+	if spec.InstanceRequirements != nil {
+		instanceTypes, err := a.awsCli.ResolveInstanceTypes(ctx, spec.BootstrapParams.OSArch, *spec.InstanceRequirements)
+		if err != nil {
+			return params.ProviderInstance{}, fmt.Errorf("failed to resolve instance types: %w", err)
+		}
+		spec.InstanceTypes = instanceTypes
+		// Resolved instance types already match the architecture.
+		flavors = nil
 	}
 
-	if err := a.awsCli.AttachInternetGateway(ctx, igwID, vpcID); err != nil {
-		return params.ProviderInstance{}, fmt.Errorf("failed to attach internet gateway: %w", err)
+	if err := a.awsCli.ValidateArchitecture(ctx, flavors, spec.BootstrapParams.Image, spec.BootstrapParams.OSArch); err != nil {
+		return params.ProviderInstance{}, fmt.Errorf("failed to validate architecture: %w", err)
 	}
 
-	subnetID, err := a.awsCli.CreateSubnet(ctx, vpcID, "10.10.0.0/24", spec.Region)
-	if err != nil {
-		return params.ProviderInstance{}, fmt.Errorf("failed to create subnet: %w", err)
+	rb := &rollback{}
+	defer func() {
+		if err == nil {
+			return
+		}
+		if rbErr := rb.run(ctx); rbErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to roll back: %w", rbErr))
+		}
+	}()
+
+	if len(spec.CandidateSubnets()) == 0 && a.cfg.NetworkMode == config.NetworkModeManaged {
+		// The managed network is shared by all runners of the controller and
+		// other creates may already rely on it, so it is not rolled back.
+		// cleanup-network removes it once no instance uses it.
+		network, err := a.awsCli.EnsureManagedNetwork(ctx, a.cfg.ManagedNetwork.VpcCIDR, a.cfg.ManagedNetwork.SubnetCIDR)
+		if err != nil {
+			return params.ProviderInstance{}, fmt.Errorf("failed to ensure managed network: %w", err)
+		}
+		spec.SetSubnet(network.SubnetID)
+	}
+
+	if len(spec.CandidateSubnets()) == 0 {
+		return params.ProviderInstance{}, fmt.Errorf("no subnet configured for runner")
 	}
 
-	instanceID, err := a.awsCli.CreateRunningInstance(ctx, spec, subnetID)
+	// Like the managed network, the runner security group is shared and
+	// left to cleanup-network.
+	if err := a.awsCli.ResolveSecurityGroups(ctx, spec); err != nil {
+		return params.ProviderInstance{}, fmt.Errorf("failed to resolve security groups: %w", err)
+	}
+
+	awsInstance, err := a.awsCli.CreateRunningInstance(ctx, spec)
 	if err != nil {
+		if ctx.Err() != nil {
+			// The create was cancelled while RunInstances or CreateFleet was
+			// in flight. EC2 may have launched the instance anyway. The
+			// lookup runs with the rollback context, which is not cancelled.
+			name := spec.BootstrapParams.Name
+			rb.add(fmt.Sprintf("terminate instance launched for %s", name), func(ctx context.Context) error {
+				orphan, err := a.awsCli.FindInstanceByName(ctx, name)
+				if err != nil || orphan == nil {
+					return err
+				}
+				return a.awsCli.TerminateInstances(ctx, []string{aws.ToString(orphan.InstanceId)})
+			})
+		}
 		return params.ProviderInstance{}, fmt.Errorf("failed to create instance: %w", err)
 	}
+	instanceID := aws.ToString(awsInstance.InstanceId)
+	rb.add(fmt.Sprintf("terminate instance %s", instanceID), func(ctx context.Context) error {
+		return a.awsCli.TerminateInstances(ctx, []string{instanceID})
+	})
 
-	instance := params.ProviderInstance{
-		ProviderID: instanceID,
-		Name:       spec.BootstrapParams.Name,
-		Status:     "running",
+	if timeout := a.cfg.Timeouts.CreateInstance; timeout > 0 {
+		running, err := a.awsCli.WaitForInstanceState(ctx, instanceID, types.InstanceStateNameRunning, timeout)
+		if err != nil {
+			// A slow boot is not a failure. Report the instance as it is now
+			// and let garm follow it, unless it went down while waiting.
+			current, getErr := a.awsCli.GetInstance(ctx, instanceID)
+			if getErr != nil || !isComingUp(current) {
+				return params.ProviderInstance{}, fmt.Errorf("failed to wait for instance: %w", err)
+			}
+			log.Printf("instance %s is not running yet: %s", instanceID, err)
+			running = current
+		}
+		awsInstance = running
 	}
 
-	return instance, nil
+	// SIGTERM cancels the context. Don't leave an instance behind that garm
+	// will never learn about.
+	if err := ctx.Err(); err != nil {
+		return params.ProviderInstance{}, fmt.Errorf("instance creation cancelled: %w", err)
+	}
+
+	instance, err = convert.AwsInstanceToParamsInstance(*awsInstance)
+	if err != nil {
+		return params.ProviderInstance{}, fmt.Errorf("failed to convert VM details: %w", err)
+	}
 
+	return instance, nil
 }
 
 func (a *AwsProvider) DeleteInstance(ctx context.Context, instance string) error {
-	err := a.awsCli.TerminateInstance(ctx, instance)
+	awsInstance, err := a.awsCli.ResolveInstance(ctx, instance)
+	if err != nil {
+		if errors.Is(err, garmErrors.ErrNotFound) {
+			// Already gone.
+			return nil
+		}
+		return fmt.Errorf("failed to get VM details: %w", err)
+	}
+
+	if awsInstance.State != nil && awsInstance.State.Name == types.InstanceStateNameTerminated {
+		return nil
+	}
+
+	instanceID := aws.ToString(awsInstance.InstanceId)
+	err = a.awsCli.TerminateInstance(ctx, instanceID)
 	if err != nil {
 		return fmt.Errorf("failed to delete instance: %w", err)
 	}
+
+	if timeout := a.cfg.Timeouts.DeleteInstance; timeout > 0 {
+		if _, err := a.awsCli.WaitForInstanceState(ctx, instanceID, types.InstanceStateNameTerminated, timeout); err != nil {
+			return fmt.Errorf("failed to wait for instance: %w", err)
+		}
+	}
 	return nil
 }
 
-// TODO: Implement this
 func (a *AwsProvider) GetInstance(ctx context.Context, instance string) (params.ProviderInstance, error) {
-	_, err := a.awsCli.GetInstance(ctx, instance)
+	awsInstance, err := a.awsCli.ResolveInstance(ctx, instance)
 	if err != nil {
 		return params.ProviderInstance{}, fmt.Errorf("failed to get VM details: %w", err)
 	}
-	//TODO: write function to convert aws.Instance to params.ProviderInstance
-	details, err := params.ProviderInstance{}, nil
+
+	details, err := convert.AwsInstanceToParamsInstance(*awsInstance)
 	if err != nil {
 		return params.ProviderInstance{}, fmt.Errorf("failed to convert VM details: %w", err)
 	}
 	return details, nil
 }
 
-// TODO: Implement this
 func (a *AwsProvider) ListInstances(ctx context.Context, poolID string) ([]params.ProviderInstance, error) {
 	instances, err := a.awsCli.ListDescribedInstances(ctx, poolID)
 	if err != nil {
@@ -126,24 +230,96 @@ func (a *AwsProvider) ListInstances(ctx context.Context, poolID string) ([]param
 		return []params.ProviderInstance{}, nil
 	}
 
-	resp := make([]params.ProviderInstance, len(instances))
-	for idx := range instances {
-		//TODO: write function to convert aws.Instance to params.ProviderInstance
-		resp[idx] = params.ProviderInstance{}
+	resp := make([]params.ProviderInstance, 0, len(instances))
+	for _, instance := range instances {
+		details, err := convert.AwsInstanceToParamsInstance(instance)
+		if err != nil {
+			if errors.Is(err, garmErrors.ErrNotFound) {
+				// Terminated instances linger in DescribeInstances for a while.
+				continue
+			}
+			return nil, fmt.Errorf("failed to convert VM details: %w", err)
+		}
+		resp = append(resp, details)
 	}
 
 	return resp, nil
 }
 
 func (a *AwsProvider) RemoveAllInstances(ctx context.Context) error {
+	instances, err := a.awsCli.ListControllerInstances(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list instances: %w", err)
+	}
+
+	instanceIDs := make([]string, 0, len(instances))
+	for _, instance := range instances {
+		if instance.InstanceId == nil {
+			continue
+		}
+		instanceIDs = append(instanceIDs, *instance.InstanceId)
+	}
+
+	if len(instanceIDs) > 0 {
+		if err := a.awsCli.TerminateInstances(ctx, instanceIDs); err != nil {
+			return fmt.Errorf("failed to remove instances: %w", err)
+		}
+	}
+
+	if _, err := a.CleanupNetwork(ctx, false); err != nil {
+		return fmt.Errorf("failed to remove network: %w", err)
+	}
 	return nil
 }
 
+// CleanupNetwork removes the network resources created by this controller
+// which no longer host any instances.
+func (a *AwsProvider) CleanupNetwork(ctx context.Context, dryRun bool) ([]client.NetworkResource, error) {
+	return a.awsCli.CleanupManagedNetwork(ctx, dryRun)
+}
+
 func (a *AwsProvider) Stop(ctx context.Context, instance string, force bool) error {
-	return a.awsCli.StopInstance(ctx, instance)
+	awsInstance, err := a.awsCli.GetInstance(ctx, instance)
+	if err != nil {
+		return fmt.Errorf("failed to get VM details: %w", err)
+	}
 
+	// Instances launched with hibernation configured are always hibernated,
+	// so they resume with warm caches.
+	hibernate := awsInstance.HibernationOptions != nil && aws.ToBool(awsInstance.HibernationOptions.Configured)
+	if err := a.awsCli.StopInstance(ctx, instance, force, hibernate); err != nil {
+		return err
+	}
+
+	if timeout := a.cfg.Timeouts.StopInstance; timeout > 0 {
+		if _, err := a.awsCli.WaitForInstanceState(ctx, instance, types.InstanceStateNameStopped, timeout); err != nil {
+			return fmt.Errorf("failed to wait for instance: %w", err)
+		}
+	}
+	return nil
 }
 
 func (a *AwsProvider) Start(ctx context.Context, instance string) error {
-	return a.awsCli.StartInstance(ctx, instance)
+	if err := a.awsCli.StartInstance(ctx, instance); err != nil {
+		return err
+	}
+
+	if timeout := a.cfg.Timeouts.StartInstance; timeout > 0 {
+		if _, err := a.awsCli.WaitForInstanceState(ctx, instance, types.InstanceStateNameRunning, timeout); err != nil {
+			return fmt.Errorf("failed to wait for instance: %w", err)
+		}
+	}
+	return nil
+}
+
+// isComingUp returns true if the instance is pending or already running.
+func isComingUp(instance *types.Instance) bool {
+	if instance == nil || instance.State == nil {
+		return false
+	}
+	switch instance.State.Name {
+	case types.InstanceStateNamePending, types.InstanceStateNameRunning:
+		return true
+	}
+	return false
 }
@@ -0,0 +1,61 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// rollbackTimeout bounds how long undoing a failed CreateInstance may take.
+// Rollback also runs after the original context was cancelled, so it uses
+// its own deadline.
+const rollbackTimeout = 5 * time.Minute
+
+type rollbackStep struct {
+	description string
+	undo        func(ctx context.Context) error
+}
+
+// rollback records the resources created during an operation, so they can be
+// removed in reverse order if the operation fails.
+type rollback struct {
+	steps []rollbackStep
+}
+
+func (r *rollback) add(description string, undo func(ctx context.Context) error) {
+	r.steps = append(r.steps, rollbackStep{
+		description: description,
+		undo:        undo,
+	})
+}
+
+// run undoes all recorded steps in reverse order. It keeps going when a step
+// fails and returns all errors encountered.
+func (r *rollback) run(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), rollbackTimeout)
+	defer cancel()
+
+	var errs []error
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		step := r.steps[i]
+		if err := step.undo(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to %s: %w", step.description, err))
+		}
+	}
+	return errors.Join(errs...)
+}
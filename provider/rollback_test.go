@@ -0,0 +1,108 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRollbackRunsInReverseOrder(t *testing.T) {
+	var order []string
+	rb := &rollback{}
+	for _, name := range []string{"first", "second", "third"} {
+		name := name
+		rb.add("delete "+name, func(ctx context.Context) error {
+			order = append(order, name)
+			return nil
+		})
+	}
+
+	if err := rb.run(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"third", "second", "first"}
+	if !slices.Equal(order, want) {
+		t.Fatalf("expected steps to run in order %v, got %v", want, order)
+	}
+}
+
+func TestRollbackContinuesAfterErrors(t *testing.T) {
+	errVolume := errors.New("volume in use")
+	errInstance := errors.New("instance not found")
+
+	var order []string
+	rb := &rollback{}
+	rb.add("delete volume", func(ctx context.Context) error {
+		order = append(order, "volume")
+		return errVolume
+	})
+	rb.add("delete security group", func(ctx context.Context) error {
+		order = append(order, "security group")
+		return nil
+	})
+	rb.add("terminate instance", func(ctx context.Context) error {
+		order = append(order, "instance")
+		return errInstance
+	})
+
+	err := rb.run(context.Background())
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	want := []string{"instance", "security group", "volume"}
+	if !slices.Equal(order, want) {
+		t.Fatalf("expected steps to run in order %v, got %v", want, order)
+	}
+	if !errors.Is(err, errVolume) || !errors.Is(err, errInstance) {
+		t.Fatalf("expected the errors of all failed steps, got %v", err)
+	}
+	for _, msg := range []string{"failed to delete volume", "failed to terminate instance"} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Fatalf("expected error to contain %q, got %v", msg, err)
+		}
+	}
+	if strings.Contains(err.Error(), "security group") {
+		t.Fatalf("expected only failed steps in the error, got %v", err)
+	}
+}
+
+func TestRollbackWithCancelledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var ran bool
+	rb := &rollback{}
+	rb.add("terminate instance", func(ctx context.Context) error {
+		ran = true
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, ok := ctx.Deadline(); !ok {
+			t.Errorf("expected the rollback context to have a deadline")
+		}
+		return nil
+	})
+
+	if err := rb.run(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !ran {
+		t.Fatalf("expected the step to run")
+	}
+}